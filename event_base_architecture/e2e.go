@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownKey is returned when a user has not published a public key
+var ErrUnknownKey = errors.New("no public key published for user")
+
+// ErrKeyExists is returned when a user publishes a key after another one
+var ErrKeyExists = errors.New("a different public key is already published for user")
+
+// KeyDirectory stores the public keys clients use for direct messages.
+// It only ever sees public keys, so the server cannot decrypt messages.
+// The directory is trust-on-first-use: the first key published for a user
+// is kept, so nobody can later substitute their own key to read the user's
+// direct messages.
+type KeyDirectory struct {
+	keys  map[string]*ecdh.PublicKey
+	mutex sync.RWMutex
+}
+
+// NewKeyDirectory creates an empty key directory
+func NewKeyDirectory() *KeyDirectory {
+	return &KeyDirectory{
+		keys: make(map[string]*ecdh.PublicKey),
+	}
+}
+
+// Publish stores the public key of a user. Publishing the same key again
+// is allowed, a different key is refused with ErrKeyExists.
+func (kd *KeyDirectory) Publish(userID string, key *ecdh.PublicKey) error {
+	kd.mutex.Lock()
+	defer kd.mutex.Unlock()
+	if current, ok := kd.keys[userID]; ok && !current.Equal(key) {
+		return fmt.Errorf("%w: %s", ErrKeyExists, userID)
+	}
+	kd.keys[userID] = key
+	return nil
+}
+
+// Lookup returns the public key of a user
+func (kd *KeyDirectory) Lookup(userID string) (*ecdh.PublicKey, error) {
+	kd.mutex.RLock()
+	defer kd.mutex.RUnlock()
+	key, ok := kd.keys[userID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, userID)
+	}
+	return key, nil
+}
+
+// EnableEncryption generates a key pair for the client and publishes the
+// public half to the directory
+func (c *Client) EnableEncryption(directory *KeyDirectory) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	if err := directory.Publish(c.ID, key.PublicKey()); err != nil {
+		return err
+	}
+	c.privateKey = key
+	c.directory = directory
+	return nil
+}
+
+// SendDirectMessage sends an end-to-end encrypted message to a single recipient
+func (c *Client) SendDirectMessage(recipient, content string) error {
+	if c.privateKey == nil {
+		return errors.New("encryption is not enabled for client " + c.ID)
+	}
+
+	msg := c.newMessage(content)
+	msg.Recipient = recipient
+	msg.Encrypted = true
+
+	aead, err := c.sharedCipher(recipient)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(content), messageAAD(msg))
+	msg.Content = base64.StdEncoding.EncodeToString(sealed)
+
+	c.eventBus.Publish(Event{
+		Type:    "messageSent",
+		Payload: msg,
+	})
+	return nil
+}
+
+// Decrypt returns the plaintext of an encrypted message addressed to the client
+func (c *Client) Decrypt(msg Message) (string, error) {
+	if !msg.Encrypted {
+		return msg.Content, nil
+	}
+	if c.privateKey == nil {
+		return "", errors.New("encryption is not enabled for client " + c.ID)
+	}
+	if msg.Recipient != c.ID {
+		return "", fmt.Errorf("message %s is addressed to %s", msg.ID, msg.Recipient)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(msg.Content)
+	if err != nil {
+		return "", fmt.Errorf("decoding message %s: %w", msg.ID, err)
+	}
+	aead, err := c.sharedCipher(msg.Sender)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("message %s is too short", msg.ID)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, messageAAD(msg))
+	if err != nil {
+		return "", fmt.Errorf("decrypting message %s: %w", msg.ID, err)
+	}
+	return string(plaintext), nil
+}
+
+// sharedCipher derives the AES-GCM cipher shared between the client and a peer
+func (c *Client) sharedCipher(peer string) (cipher.AEAD, error) {
+	peerKey, err := c.directory.Lookup(peer)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := c.privateKey.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("deriving shared secret: %w", err)
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// messageAAD binds the ciphertext to its routing fields so they cannot be
+// swapped by the server
+func messageAAD(msg Message) []byte {
+	return []byte(msg.ID + "\x00" + msg.Sender + "\x00" + msg.Recipient)
+}
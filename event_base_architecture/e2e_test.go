@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+)
+
+// encryptedClients creates clients with encryption enabled on one directory
+func encryptedClients(t *testing.T, bus *EventBus, ids ...string) []*Client {
+	t.Helper()
+	directory := NewKeyDirectory()
+	clients := make([]*Client, len(ids))
+	for i, id := range ids {
+		clients[i] = &Client{ID: id, eventBus: bus}
+		if err := clients[i].EnableEncryption(directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return clients
+}
+
+func TestDirectMessagesAreEncryptedForRecipient(t *testing.T) {
+	bus := NewEventBus(nil)
+	sent := make(chan Event, 1)
+	bus.Subscribe("messageSent", sent)
+	clients := encryptedClients(t, bus, "alice", "bob", "carol")
+	alice, bob, carol := clients[0], clients[1], clients[2]
+
+	if err := bob.SendDirectMessage("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	select {
+	case event := <-sent:
+		msg = event.Payload
+	case <-time.After(time.Second):
+		t.Fatal("direct message was not published")
+	}
+
+	if !msg.Encrypted || msg.Recipient != "alice" || msg.Content == "secret" {
+		t.Fatalf("published message = %+v, want ciphertext for alice", msg)
+	}
+	if content, err := alice.Decrypt(msg); err != nil || content != "secret" {
+		t.Errorf("alice.Decrypt = %q, %v, want secret", content, err)
+	}
+	if _, err := carol.Decrypt(msg); err == nil {
+		t.Error("carol decrypted a message addressed to alice")
+	}
+
+	// The routing fields are authenticated
+	forged := msg
+	forged.Sender = "carol"
+	if _, err := alice.Decrypt(forged); err == nil {
+		t.Error("alice decrypted a message with a forged sender")
+	}
+
+	if err := bob.SendDirectMessage("dave", "hi"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("message to a user without key: err = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyDirectoryKeepsTheFirstKey(t *testing.T) {
+	directory := NewKeyDirectory()
+	first, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	second, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err := directory.Publish("alice", first.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := directory.Publish("alice", first.PublicKey()); err != nil {
+		t.Errorf("publishing the same key again: %v", err)
+	}
+	if err := directory.Publish("alice", second.PublicKey()); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("publishing another key: err = %v, want ErrKeyExists", err)
+	}
+	if key, err := directory.Lookup("alice"); err != nil || !key.Equal(first.PublicKey()) {
+		t.Errorf("Lookup = %v, %v, want the first key", key, err)
+	}
+
+	impostor := &Client{ID: "alice", eventBus: NewEventBus(nil)}
+	if err := impostor.EnableEncryption(directory); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("EnableEncryption for a taken user: err = %v, want ErrKeyExists", err)
+	}
+	if _, err := directory.Lookup("bob"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Lookup of an unknown user: err = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestNotifierRoutesDirectMessagesToRecipient(t *testing.T) {
+	bus := NewEventBus(nil)
+	notifier := NewMessageNotifier(bus)
+	notifier.Start()
+	aliceCh := notifier.RegisterClient("alice")
+	bobCh := notifier.RegisterClient("bob")
+	carolCh := notifier.RegisterClient("carol")
+
+	bus.Publish(Event{Type: "messagePublish", Payload: Message{ID: "1", Sender: "bob", Recipient: "alice"}})
+	if msg := receive(t, aliceCh); msg.ID != "1" {
+		t.Fatalf("alice received %+v", msg)
+	}
+	// The notifier handles one event at a time, so once carol got the
+	// second message the first one was fully routed
+	bus.Publish(Event{Type: "messagePublish", Payload: Message{ID: "2", Sender: "bob", Recipient: "carol"}})
+	if msg := receive(t, carolCh); msg.ID != "2" {
+		t.Errorf("carol received %+v, want only the message addressed to her", msg)
+	}
+	if msgs := append(pending(aliceCh), append(pending(bobCh), pending(carolCh)...)...); len(msgs) != 0 {
+		t.Errorf("direct messages reached other clients: %+v", msgs)
+	}
+}
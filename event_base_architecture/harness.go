@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HarnessEpoch is the time a Harness clock starts at
+var HarnessEpoch = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Harness wires components to a synchronous event bus and a fake clock and
+// records every published event, so tests need no sleeps:
+//
+//	h := NewHarness()
+//	(&MessageReceiver{eventBus: h.Bus}).Start()
+//	h.Client("alice").SendMessage("hi")
+//	if err := h.ExpectTypes("messageSent", "messageCreate"); err != nil {
+//		t.Fatal(err)
+//	}
+type Harness struct {
+	Bus   *EventBus
+	Clock *FakeClock
+
+	events []Event
+	ids    int
+	mutex  sync.Mutex
+}
+
+// NewHarness creates a harness whose clock starts at HarnessEpoch. Messages
+// get the IDs msg-1, msg-2, ... in the order they are created.
+func NewHarness() *Harness {
+	h := &Harness{
+		Clock: NewFakeClock(HarnessEpoch),
+	}
+	h.Bus = NewSyncEventBus(nil, h.Clock)
+	h.Bus.observer = h.record
+	h.Bus.newID = h.nextID
+	return h
+}
+
+func (h *Harness) nextID() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.ids++
+	return fmt.Sprintf("msg-%d", h.ids)
+}
+
+func (h *Harness) record(event Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.events = append(h.events, event)
+}
+
+// Client creates a client connected to the harness bus
+func (h *Harness) Client(id string) *Client {
+	return &Client{ID: id, eventBus: h.Bus}
+}
+
+// RateLimiter creates a rate limiter that refills on the harness clock
+func (h *Harness) RateLimiter(limits map[string]RateLimit) *RateLimiter {
+	rl := NewRateLimiter(limits)
+	rl.clock = h.Clock
+	return rl
+}
+
+// Events returns the events published so far in publish order
+func (h *Harness) Events() []Event {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	result := make([]Event, len(h.events))
+	copy(result, h.events)
+	return result
+}
+
+// EventTypes returns the types of the events published so far in publish order
+func (h *Harness) EventTypes() []string {
+	events := h.Events()
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+// EventsOfType returns the published events of a single type
+func (h *Harness) EventsOfType(eventType string) []Event {
+	var result []Event
+	for _, event := range h.Events() {
+		if event.Type == eventType {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+// Reset forgets the events recorded so far
+func (h *Harness) Reset() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.events = nil
+}
+
+// ExpectTypes returns an error unless exactly the given event types were
+// published, in that order
+func (h *Harness) ExpectTypes(types ...string) error {
+	got := h.EventTypes()
+	if strings.Join(got, ",") != strings.Join(types, ",") {
+		return fmt.Errorf("published events %v, want %v", got, types)
+	}
+	return nil
+}
+
+// ExpectSubsequence returns an error unless the given event types were
+// published in that order, possibly with other events in between
+func (h *Harness) ExpectSubsequence(types ...string) error {
+	got := h.EventTypes()
+	next := 0
+	for _, eventType := range got {
+		if next < len(types) && eventType == types[next] {
+			next++
+		}
+	}
+	if next < len(types) {
+		return fmt.Errorf("published events %v, missing %q in sequence %v", got, types[next], types)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterDropsMessagesBeyondBurst(t *testing.T) {
+	h := NewHarness()
+	limiter := h.RateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 2, Refill: time.Second},
+		"admin":     {Burst: 3, Refill: time.Second},
+	})
+	limiter.AssignRole("alice", "admin")
+	(&MessageReceiver{eventBus: h.Bus, limiter: limiter}).Start()
+
+	bob := h.Client("bob")
+	for _, content := range []string{"1", "2", "3"} {
+		bob.SendMessage(content)
+	}
+	if err := h.ExpectTypes(
+		"messageSent", "messageCreate",
+		"messageSent", "messageCreate",
+		"messageSent", "rateLimited",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// Admins get a larger burst
+	h.Reset()
+	alice := h.Client("alice")
+	for _, content := range []string{"1", "2", "3", "4"} {
+		alice.SendMessage(content)
+	}
+	if got := len(h.EventsOfType("messageCreate")); got != 3 {
+		t.Errorf("admin messages accepted = %d, want 3", got)
+	}
+
+	// One refill period later bob may send again
+	h.Reset()
+	h.Clock.Advance(time.Second)
+	bob.SendMessage("4")
+	if err := h.ExpectTypes("messageSent", "messageCreate"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitedNoticeGoesToSenderOnly(t *testing.T) {
+	h := NewHarness()
+	limiter := h.RateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 1, Refill: time.Minute},
+	})
+	(&MessageReceiver{eventBus: h.Bus, limiter: limiter}).Start()
+
+	alice := h.Client("alice")
+	bob := h.Client("bob")
+	aliceNotices := alice.RateLimits()
+	bobNotices := bob.RateLimits()
+
+	bob.SendMessage("first")
+	bob.SendMessage("second")
+
+	notices := pending(bobNotices)
+	if len(notices) != 1 || notices[0].Content != "second" {
+		t.Fatalf("bob notices = %+v, want the second message", notices)
+	}
+	if notices := pending(aliceNotices); len(notices) != 0 {
+		t.Errorf("alice got notices for bob's messages: %+v", notices)
+	}
+	if got := h.EventsOfType("rateLimited"); len(got) != 1 || got[0].Payload.ID != notices[0].ID {
+		t.Errorf("rateLimited events = %+v", got)
+	}
+}
+
+func TestDirectMessagesOnlyReachRecipient(t *testing.T) {
+	h := NewHarness()
+	(&MessageReceiver{eventBus: h.Bus}).Start()
+	(&MessagePublisher{eventBus: h.Bus}).Start()
+	notifier := NewMessageNotifier(h.Bus)
+	notifier.Start()
+
+	directory := NewKeyDirectory()
+	alice, bob, carol := h.Client("alice"), h.Client("bob"), h.Client("carol")
+	for _, c := range []*Client{alice, bob, carol} {
+		if err := c.EnableEncryption(directory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceCh := notifier.RegisterClient("alice")
+	bobCh := notifier.RegisterClient("bob")
+	carolCh := notifier.RegisterClient("carol")
+
+	if err := bob.SendDirectMessage("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ExpectTypes("messageSent", "messageCreate", "messagePublish"); err != nil {
+		t.Fatal(err)
+	}
+
+	received := pending(aliceCh)
+	if len(received) != 1 {
+		t.Fatalf("alice received %d messages, want 1", len(received))
+	}
+	msg := received[0]
+	if msg.Content == "secret" || !msg.Encrypted {
+		t.Errorf("direct message was delivered in plaintext: %+v", msg)
+	}
+	if content, err := alice.Decrypt(msg); err != nil || content != "secret" {
+		t.Errorf("alice.Decrypt = %q, %v", content, err)
+	}
+	if _, err := carol.Decrypt(msg); err == nil {
+		t.Error("carol decrypted a message addressed to alice")
+	}
+	if got := pending(bobCh); len(got) != 0 {
+		t.Errorf("sender was notified of own message: %+v", got)
+	}
+	if got := pending(carolCh); len(got) != 0 {
+		t.Errorf("carol was notified of a direct message to alice: %+v", got)
+	}
+
+	// Messages to everyone still reach all other clients
+	alice.SendMessage("hello")
+	if len(pending(bobCh)) != 1 || len(pending(carolCh)) != 1 || len(pending(aliceCh)) != 0 {
+		t.Error("broadcast message was not delivered to every other client")
+	}
+}
+
+func TestHarnessClockOnlyMovesOnAdvance(t *testing.T) {
+	h := NewHarness()
+	(&MessageReceiver{eventBus: h.Bus}).Start()
+	alice := h.Client("alice")
+	alice.SendMessage("first")
+	alice.SendMessage("second")
+
+	events := h.EventsOfType("messageCreate")
+	if len(events) != 2 {
+		t.Fatalf("messageCreate events = %d, want 2", len(events))
+	}
+	first, second := events[0].Payload, events[1].Payload
+	if first.ID != "msg-1" || second.ID != "msg-2" {
+		t.Errorf("message IDs = %s, %s, want msg-1, msg-2", first.ID, second.ID)
+	}
+	if !first.Timestamp.Equal(HarnessEpoch) || !second.Timestamp.Equal(HarnessEpoch) {
+		t.Errorf("timestamps = %v, %v, want the epoch", first.Timestamp, second.Timestamp)
+	}
+
+	h.Clock.Advance(time.Minute)
+	if got := h.Clock.Now(); !got.Equal(HarnessEpoch.Add(time.Minute)) {
+		t.Errorf("Now after Advance = %v", got)
+	}
+	if err := h.ExpectSubsequence("messageSent", "messageCreate", "messageCreate"); err != nil {
+		t.Error(err)
+	}
+	if err := h.ExpectSubsequence("messageCreate", "messageSent", "messageSent"); err == nil {
+		t.Error("ExpectSubsequence accepted events out of order")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/ecdh"
 	"fmt"
 	"log"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -13,6 +15,9 @@ type Message struct {
 	Sender    string
 	Content   string
 	Timestamp time.Time
+	Recipient string // empty for messages to everyone
+	Room      string // empty for the default room
+	Encrypted bool   // Content is base64 ciphertext only the recipient can read
 }
 
 // Event represents an event in the system
@@ -24,16 +29,36 @@ type Event struct {
 // EventBus handles event distribution
 type EventBus struct {
 	subscribers map[string][]chan Event
+	metrics     *Metrics // shared by all components, may be nil
+	clock       Clock
 	mutex       sync.RWMutex
+
+	// Set by NewSyncEventBus, handlers then run inline in Publish
+	sync     bool
+	handlers map[string][]func(Event)
+	observer func(Event)   // sees every published event, may be nil
+	newID    func() string // generates message IDs, nil derives them from the clock
 }
 
-// NewEventBus creates a new event bus
-func NewEventBus() *EventBus {
+// NewEventBus creates a new event bus, metrics may be nil
+func NewEventBus(metrics *Metrics) *EventBus {
 	return &EventBus{
 		subscribers: make(map[string][]chan Event),
+		metrics:     metrics,
+		clock:       realClock{},
 	}
 }
 
+// NewSyncEventBus creates an event bus that runs handlers inline, so an
+// event and everything it causes are processed before Publish returns
+func NewSyncEventBus(metrics *Metrics, clock Clock) *EventBus {
+	eb := NewEventBus(metrics)
+	eb.clock = clock
+	eb.sync = true
+	eb.handlers = make(map[string][]func(Event))
+	return eb
+}
+
 // Subscribe registers a subscriber for a specific event type
 func (eb *EventBus) Subscribe(eventType string, ch chan Event) {
 	eb.mutex.Lock()
@@ -41,19 +66,53 @@ func (eb *EventBus) Subscribe(eventType string, ch chan Event) {
 	eb.subscribers[eventType] = append(eb.subscribers[eventType], ch)
 }
 
+// SubscribeFunc registers a handler for a specific event type. Events are
+// handled one at a time in the order they are taken from the bus.
+func (eb *EventBus) SubscribeFunc(eventType string, handler func(Event)) {
+	if eb.sync {
+		eb.mutex.Lock()
+		defer eb.mutex.Unlock()
+		eb.handlers[eventType] = append(eb.handlers[eventType], handler)
+		return
+	}
+
+	ch := make(chan Event)
+	eb.Subscribe(eventType, ch)
+	go func() {
+		for event := range ch {
+			handler(event)
+		}
+	}()
+}
+
 // Publish sends an event to all subscribers of that event type
 func (eb *EventBus) Publish(event Event) {
+	// Copy the subscribers so inline handlers can publish without
+	// taking the lock recursively
 	eb.mutex.RLock()
-	defer eb.mutex.RUnlock()
-	subscribers, exists := eb.subscribers[event.Type]
-	if !exists {
-		return
+	subscribers := eb.subscribers[event.Type]
+	handlers := eb.handlers[event.Type]
+	observer := eb.observer
+	eb.mutex.RUnlock()
+
+	eb.metrics.EventPublished(event.Type)
+	if observer != nil {
+		observer(event)
 	}
 
-	for _, ch := range subscribers {
-		go func(c chan Event) {
+	for i, ch := range subscribers {
+		eb.metrics.DeliveryQueued(event.Type, i)
+		go func(c chan Event, index int, queued time.Time) {
 			c <- event
-		}(ch)
+			eb.metrics.DeliveryDone(event.Type, index, time.Since(queued))
+		}(ch, i, time.Now())
+	}
+
+	for i, handler := range handlers {
+		index := len(subscribers) + i
+		eb.metrics.DeliveryQueued(event.Type, index)
+		eb.metrics.DeliveryDone(event.Type, index, 0)
+		handler(event)
 	}
 }
 
@@ -61,45 +120,93 @@ func (eb *EventBus) Publish(event Event) {
 type Client struct {
 	ID       string
 	eventBus *EventBus
+
+	// Set by EnableEncryption for direct messages
+	privateKey *ecdh.PrivateKey
+	directory  *KeyDirectory
 }
 
-// SendMessage sends a message from the client
-func (c *Client) SendMessage(content string) {
-	msg := Message{
-		ID:        fmt.Sprintf("msg-%d", time.Now().UnixNano()),
+// newMessage creates a message from the client
+func (c *Client) newMessage(content string) Message {
+	now := c.eventBus.clock.Now()
+	id := fmt.Sprintf("msg-%d", now.UnixNano())
+	if c.eventBus.newID != nil {
+		id = c.eventBus.newID()
+	}
+	return Message{
+		ID:        id,
 		Sender:    c.ID,
 		Content:   content,
-		Timestamp: time.Now(),
+		Timestamp: now,
 	}
+}
 
+// SendMessage sends a message from the client
+func (c *Client) SendMessage(content string) {
+	c.eventBus.Publish(Event{
+		Type:    "messageSent",
+		Payload: c.newMessage(content),
+	})
+}
+
+// SendToRoom sends a message from the client to a room
+func (c *Client) SendToRoom(room, content string) {
+	msg := c.newMessage(content)
+	msg.Room = room
 	c.eventBus.Publish(Event{
 		Type:    "messageSent",
 		Payload: msg,
 	})
 }
 
+// RateLimits returns a channel that receives the client's messages
+// rejected by the rate limiter
+func (c *Client) RateLimits() chan Message {
+	notices := make(chan Message, 10)
+	c.eventBus.SubscribeFunc("rateLimited", func(event Event) {
+		if event.Payload.Sender != c.ID {
+			return
+		}
+		select {
+		case notices <- event.Payload:
+			// Notice sent to client
+		default:
+			// Client buffer is full, skip notice
+		}
+	})
+	return notices
+}
+
 // MessageReceiver handles incoming messages
 type MessageReceiver struct {
 	eventBus *EventBus
+	limiter  *RateLimiter // optional, nil disables rate limiting
 }
 
 // Start begins listening for incoming messages
 func (mr *MessageReceiver) Start() {
-	ch := make(chan Event)
-	mr.eventBus.Subscribe("messageSent", ch)
+	mr.eventBus.SubscribeFunc("messageSent", func(event Event) {
+		if mr.limiter != nil && !mr.limiter.Allow(event.Payload.Sender) {
+			log.Printf("Rate limited message %s from %s",
+				event.Payload.ID, event.Payload.Sender)
 
-	go func() {
-		for event := range ch {
-			log.Printf("Message received: %s from %s",
-				event.Payload.Content, event.Payload.Sender)
-
-			// Create message event for other components
+			// Tell the sender that the message was dropped
 			mr.eventBus.Publish(Event{
-				Type:    "messageCreate",
+				Type:    "rateLimited",
 				Payload: event.Payload,
 			})
+			return
 		}
-	}()
+
+		log.Printf("Message received: %s from %s",
+			event.Payload.Content, event.Payload.Sender)
+
+		// Create message event for other components
+		mr.eventBus.Publish(Event{
+			Type:    "messageCreate",
+			Payload: event.Payload,
+		})
+	})
 }
 
 // MessageSaver saves messages to storage
@@ -111,17 +218,13 @@ type MessageSaver struct {
 
 // Start begins listening for messages to save
 func (ms *MessageSaver) Start() {
-	ch := make(chan Event)
-	ms.eventBus.Subscribe("messageCreate", ch)
-
-	go func() {
-		for event := range ch {
-			ms.mutex.Lock()
-			ms.messages = append(ms.messages, event.Payload)
-			ms.mutex.Unlock()
-			log.Printf("Message saved: %s", event.Payload.ID)
-		}
-	}()
+	ms.eventBus.SubscribeFunc("messageCreate", func(event Event) {
+		ms.mutex.Lock()
+		ms.messages = append(ms.messages, event.Payload)
+		ms.mutex.Unlock()
+		ms.eventBus.metrics.MessageSaved()
+		log.Printf("Message saved: %s", event.Payload.ID)
+	})
 }
 
 // GetMessages retrieves saved messages
@@ -140,20 +243,15 @@ type MessagePublisher struct {
 
 // Start begins listening for messages to publish
 func (mp *MessagePublisher) Start() {
-	ch := make(chan Event)
-	mp.eventBus.Subscribe("messageCreate", ch)
-
-	go func() {
-		for event := range ch {
-			log.Printf("Publishing message: %s", event.Payload.ID)
-
-			// Publish message event for notifications
-			mp.eventBus.Publish(Event{
-				Type:    "messagePublish",
-				Payload: event.Payload,
-			})
-		}
-	}()
+	mp.eventBus.SubscribeFunc("messageCreate", func(event Event) {
+		log.Printf("Publishing message: %s", event.Payload.ID)
+
+		// Publish message event for notifications
+		mp.eventBus.Publish(Event{
+			Type:    "messagePublish",
+			Payload: event.Payload,
+		})
+	})
 }
 
 // MessageNotifier notifies clients about new messages
@@ -182,36 +280,55 @@ func (mn *MessageNotifier) RegisterClient(clientID string) chan Message {
 
 // Start begins listening for messages to notify about
 func (mn *MessageNotifier) Start() {
-	ch := make(chan Event)
-	mn.eventBus.Subscribe("messagePublish", ch)
-
-	go func() {
-		for event := range ch {
-			log.Printf("Notification for message: %s", event.Payload.ID)
-
-			// Notify all clients except the sender
-			mn.mutex.RLock()
-			for clientID, clientCh := range mn.clients {
-				if clientID != event.Payload.Sender {
-					select {
-					case clientCh <- event.Payload:
-						// Message sent to client
-					default:
-						// Client buffer is full, skip notification
-					}
+	mn.eventBus.SubscribeFunc("messagePublish", func(event Event) {
+		log.Printf("Notification for message: %s", event.Payload.ID)
+
+		// Notify all clients except the sender, direct messages
+		// only go to their recipient
+		mn.mutex.RLock()
+		for clientID, clientCh := range mn.clients {
+			recipient := event.Payload.Recipient
+			if recipient != "" && clientID != recipient {
+				continue
+			}
+			if clientID != event.Payload.Sender {
+				select {
+				case clientCh <- event.Payload:
+					// Message sent to client
+				default:
+					// Client buffer is full, skip notification
+					mn.eventBus.metrics.NotificationDropped(clientID)
 				}
 			}
-			mn.mutex.RUnlock()
 		}
-	}()
+		mn.mutex.RUnlock()
+	})
 }
 
 func main() {
+	// Expose pipeline metrics for Prometheus
+	metrics := NewMetrics()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		log.Println("Metrics available on :2112/metrics")
+		if err := http.ListenAndServe(":2112", mux); err != nil {
+			log.Printf("Metrics server failed: %v", err)
+		}
+	}()
+
 	// Initialize the event bus
-	eventBus := NewEventBus()
+	eventBus := NewEventBus(metrics)
+
+	// Limit how fast each sender may post, admins get a larger budget
+	limiter := NewRateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 5, Refill: time.Second},
+		"admin":     {Burst: 20, Refill: 100 * time.Millisecond},
+	})
+	limiter.AssignRole("alice", "admin")
 
 	// Initialize components
-	messageReceiver := &MessageReceiver{eventBus: eventBus}
+	messageReceiver := &MessageReceiver{eventBus: eventBus, limiter: limiter}
 	messageSaver := &MessageSaver{eventBus: eventBus, messages: []Message{}}
 	messagePublisher := &MessagePublisher{eventBus: eventBus}
 	messageNotifier := NewMessageNotifier(eventBus)
@@ -222,6 +339,14 @@ func main() {
 	messagePublisher.Start()
 	messageNotifier.Start()
 
+	// Keep a day of history and at most 1000 messages per room
+	compactor := NewCompactor(messageSaver, RetentionPolicy{
+		MaxAge:     24 * time.Hour,
+		MaxPerRoom: 1000,
+	})
+	compactor.Start(time.Minute)
+	defer compactor.Stop()
+
 	// Create clients
 	alice := &Client{ID: "alice", eventBus: eventBus}
 	bob := &Client{ID: "bob", eventBus: eventBus}
@@ -229,17 +354,50 @@ func main() {
 	// Register clients for notifications
 	aliceChannel := messageNotifier.RegisterClient("alice")
 	bobChannel := messageNotifier.RegisterClient("bob")
+	aliceLimits := alice.RateLimits()
+	bobLimits := bob.RateLimits()
+
+	// Exchange public keys for direct messages
+	keyDirectory := NewKeyDirectory()
+	if err := alice.EnableEncryption(keyDirectory); err != nil {
+		log.Fatalf("Enabling encryption for alice: %v", err)
+	}
+	if err := bob.EnableEncryption(keyDirectory); err != nil {
+		log.Fatalf("Enabling encryption for bob: %v", err)
+	}
 
 	// Start listening for notifications in separate goroutines
 	go func() {
 		for msg := range aliceChannel {
-			fmt.Printf("Alice received: %s from %s\n", msg.Content, msg.Sender)
+			content, err := alice.Decrypt(msg)
+			if err != nil {
+				log.Printf("Alice could not read %s: %v", msg.ID, err)
+				continue
+			}
+			fmt.Printf("Alice received: %s from %s\n", content, msg.Sender)
 		}
 	}()
 
 	go func() {
 		for msg := range bobChannel {
-			fmt.Printf("Bob received: %s from %s\n", msg.Content, msg.Sender)
+			content, err := bob.Decrypt(msg)
+			if err != nil {
+				log.Printf("Bob could not read %s: %v", msg.ID, err)
+				continue
+			}
+			fmt.Printf("Bob received: %s from %s\n", content, msg.Sender)
+		}
+	}()
+
+	go func() {
+		for msg := range aliceLimits {
+			fmt.Printf("Alice was rate limited: %s\n", msg.Content)
+		}
+	}()
+
+	go func() {
+		for msg := range bobLimits {
+			fmt.Printf("Bob was rate limited: %s\n", msg.Content)
 		}
 	}()
 
@@ -251,6 +409,11 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 
 	alice.SendMessage("I'm good, thanks!")
+	time.Sleep(100 * time.Millisecond)
+
+	if err := bob.SendDirectMessage("alice", "Can we talk privately?"); err != nil {
+		log.Printf("Sending direct message: %v", err)
+	}
 
 	// Wait to see the results
 	time.Sleep(500 * time.Millisecond)
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the delivery latency histogram
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// histogram is a cumulative histogram in the Prometheus sense
+type histogram struct {
+	counts []uint64 // one per bucket, plus +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(latencyBuckets)]++
+	h.sum += value
+	h.count++
+}
+
+// subscriberKey identifies a subscriber channel by event type and position
+type subscriberKey struct {
+	eventType string
+	index     int
+}
+
+// Metrics collects counters and histograms for the event bus and chat pipeline.
+// A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	published  map[string]uint64
+	latency    map[string]*histogram
+	queueDepth map[subscriberKey]int64
+	dropped    map[string]uint64
+	saved      uint64
+	purged     uint64
+	mutex      sync.Mutex
+}
+
+// NewMetrics creates an empty metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		published:  make(map[string]uint64),
+		latency:    make(map[string]*histogram),
+		queueDepth: make(map[subscriberKey]int64),
+		dropped:    make(map[string]uint64),
+	}
+}
+
+// EventPublished counts an event published on the bus
+func (m *Metrics) EventPublished(eventType string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.published[eventType]++
+}
+
+// DeliveryQueued records an event waiting to be taken by a subscriber
+func (m *Metrics) DeliveryQueued(eventType string, subscriber int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queueDepth[subscriberKey{eventType, subscriber}]++
+}
+
+// DeliveryDone records that a subscriber took an event after waiting for latency
+func (m *Metrics) DeliveryDone(eventType string, subscriber int, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.queueDepth[subscriberKey{eventType, subscriber}]--
+	h, ok := m.latency[eventType]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[eventType] = h
+	}
+	h.observe(latency.Seconds())
+}
+
+// NotificationDropped counts a notification skipped because the client buffer was full
+func (m *Metrics) NotificationDropped(clientID string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dropped[clientID]++
+}
+
+// MessageSaved counts a message stored by the MessageSaver
+func (m *Metrics) MessageSaved() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.saved++
+}
+
+// MessagesPurged counts messages removed by the retention compactor
+func (m *Metrics) MessagesPurged(n int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.purged += uint64(n)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var b strings.Builder
+
+	writeHeader(&b, "eventbus_events_published_total", "counter", "Events published on the bus by type.")
+	for _, eventType := range sortedKeys(m.published) {
+		fmt.Fprintf(&b, "eventbus_events_published_total{type=%s} %d\n", labelValue(eventType), m.published[eventType])
+	}
+
+	writeHeader(&b, "eventbus_delivery_latency_seconds", "histogram", "Time from publish until a subscriber takes the event.")
+	for _, eventType := range sortedKeys(m.latency) {
+		h := m.latency[eventType]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "eventbus_delivery_latency_seconds_bucket{type=%s,le=\"%g\"} %d\n", labelValue(eventType), bound, h.counts[i])
+		}
+		fmt.Fprintf(&b, "eventbus_delivery_latency_seconds_bucket{type=%s,le=\"+Inf\"} %d\n", labelValue(eventType), h.counts[len(latencyBuckets)])
+		fmt.Fprintf(&b, "eventbus_delivery_latency_seconds_sum{type=%s} %g\n", labelValue(eventType), h.sum)
+		fmt.Fprintf(&b, "eventbus_delivery_latency_seconds_count{type=%s} %d\n", labelValue(eventType), h.count)
+	}
+
+	writeHeader(&b, "eventbus_subscriber_queue_depth", "gauge", "Events waiting to be taken by a subscriber.")
+	keys := make([]subscriberKey, 0, len(m.queueDepth))
+	for key := range m.queueDepth {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].eventType != keys[j].eventType {
+			return keys[i].eventType < keys[j].eventType
+		}
+		return keys[i].index < keys[j].index
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "eventbus_subscriber_queue_depth{type=%s,subscriber=\"%d\"} %d\n", labelValue(key.eventType), key.index, m.queueDepth[key])
+	}
+
+	writeHeader(&b, "chat_notifications_dropped_total", "counter", "Notifications skipped because the client buffer was full.")
+	for _, clientID := range sortedKeys(m.dropped) {
+		fmt.Fprintf(&b, "chat_notifications_dropped_total{client=%s} %d\n", labelValue(clientID), m.dropped[clientID])
+	}
+
+	writeHeader(&b, "chat_messages_saved_total", "counter", "Messages stored by the message saver.")
+	fmt.Fprintf(&b, "chat_messages_saved_total %d\n", m.saved)
+
+	writeHeader(&b, "chat_messages_purged_total", "counter", "Messages removed by the retention compactor.")
+	fmt.Fprintf(&b, "chat_messages_purged_total %d\n", m.purged)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// labelEscaper escapes the characters the Prometheus text format requires
+// to be escaped in label values, and only those
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue returns a quoted label value
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
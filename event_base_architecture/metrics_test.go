@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exposition returns the metrics in the text format
+func exposition(t *testing.T, m *Metrics) string {
+	t.Helper()
+	var b strings.Builder
+	n, err := m.WriteTo(&b)
+	if err != nil || n != int64(b.Len()) {
+		t.Fatalf("WriteTo = %d, %v for %d bytes", n, err, b.Len())
+	}
+	return b.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := NewMetrics()
+	m.EventPublished("messageSent")
+	m.EventPublished("messageSent")
+	m.DeliveryQueued("messageSent", 0)
+	m.DeliveryDone("messageSent", 0, 2*time.Millisecond)
+	m.DeliveryQueued("messageSent", 1)
+	m.NotificationDropped("bob")
+	m.MessageSaved()
+
+	out := exposition(t, m)
+	for _, line := range []string{
+		"# TYPE eventbus_events_published_total counter",
+		`eventbus_events_published_total{type="messageSent"} 2`,
+		`eventbus_delivery_latency_seconds_bucket{type="messageSent",le="0.001"} 0`,
+		`eventbus_delivery_latency_seconds_bucket{type="messageSent",le="0.005"} 1`,
+		`eventbus_delivery_latency_seconds_bucket{type="messageSent",le="+Inf"} 1`,
+		`eventbus_delivery_latency_seconds_count{type="messageSent"} 1`,
+		`eventbus_subscriber_queue_depth{type="messageSent",subscriber="0"} 0`,
+		`eventbus_subscriber_queue_depth{type="messageSent",subscriber="1"} 1`,
+		`chat_notifications_dropped_total{client="bob"} 1`,
+		"chat_messages_saved_total 1",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("exposition lacks %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestMetricsEscapeLabelValues(t *testing.T) {
+	m := NewMetrics()
+	m.NotificationDropped("zoë \"the\" \\ \n")
+
+	want := `chat_notifications_dropped_total{client="zoë \"the\" \\ \n"} 1` + "\n"
+	if out := exposition(t, m); !strings.Contains(out, want) {
+		t.Errorf("exposition lacks %q:\n%s", want, out)
+	}
+}
+
+func TestEventBusTracksQueueDepth(t *testing.T) {
+	m := NewMetrics()
+	bus := NewEventBus(m)
+	ch := make(chan Event)
+	bus.Subscribe("messageSent", ch)
+
+	// The event waits until the subscriber takes it
+	bus.Publish(Event{Type: "messageSent"})
+	want := `eventbus_subscriber_queue_depth{type="messageSent",subscriber="0"} 1`
+	if out := exposition(t, m); !strings.Contains(out, want) {
+		t.Errorf("exposition lacks %q:\n%s", want, out)
+	}
+	<-ch
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	var m *Metrics
+	m.EventPublished("messageSent")
+	m.DeliveryQueued("messageSent", 0)
+	m.DeliveryDone("messageSent", 0, time.Millisecond)
+	m.NotificationDropped("bob")
+	m.MessageSaved()
+
+	if out := exposition(t, m); out != "" {
+		t.Errorf("nil metrics wrote %q", out)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 || rec.Body.Len() != 0 {
+		t.Errorf("nil metrics served %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultRole is used for senders that were never assigned a role
+const DefaultRole = "member"
+
+// RateLimit configures the token bucket for a role
+type RateLimit struct {
+	Burst  int           // maximum number of messages sent back to back
+	Refill time.Duration // time needed to regain one token
+}
+
+// tokenBucket tracks the remaining tokens of a single sender
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// minSweepBuckets is the number of buckets above which full buckets are swept
+const minSweepBuckets = 1024
+
+// RateLimiter enforces per-sender token buckets with limits per role
+type RateLimiter struct {
+	limits  map[string]RateLimit
+	roles   map[string]string
+	buckets map[string]*tokenBucket
+	sweepAt int // bucket count that triggers the next sweep
+	clock   Clock
+	mutex   sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter with the given limits per role.
+// The limit for DefaultRole applies to senders without an assigned role.
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		roles:   make(map[string]string),
+		buckets: make(map[string]*tokenBucket),
+		sweepAt: minSweepBuckets,
+		clock:   realClock{},
+	}
+}
+
+// AssignRole sets the role used to pick the limit for a sender
+func (rl *RateLimiter) AssignRole(senderID, role string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.roles[senderID] = role
+	// Start over so the new burst size takes effect immediately
+	delete(rl.buckets, senderID)
+}
+
+// Allow reports whether the sender may send a message now and consumes a token if so
+func (rl *RateLimiter) Allow(senderID string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	limit, ok := rl.limitOf(senderID)
+	if !ok {
+		// Roles without a configured limit are not rate limited
+		return true
+	}
+
+	now := rl.clock.Now()
+	bucket, exists := rl.buckets[senderID]
+	if !exists {
+		if len(rl.buckets) >= rl.sweepAt {
+			rl.sweep(now)
+		}
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		rl.buckets[senderID] = bucket
+	}
+
+	bucket.tokens = bucket.refilled(limit, now)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// limitOf returns the limit of the sender's role, if it has one
+func (rl *RateLimiter) limitOf(senderID string) (RateLimit, bool) {
+	role, ok := rl.roles[senderID]
+	if !ok {
+		role = DefaultRole
+	}
+	limit, ok := rl.limits[role]
+	return limit, ok
+}
+
+// refilled returns the tokens of the bucket at now
+func (b *tokenBucket) refilled(limit RateLimit, now time.Time) float64 {
+	tokens := b.tokens
+	if limit.Refill > 0 {
+		tokens += float64(now.Sub(b.last)) / float64(limit.Refill)
+	}
+	if tokens > float64(limit.Burst) {
+		tokens = float64(limit.Burst)
+	}
+	return tokens
+}
+
+// sweep drops the buckets that have refilled completely, as a sender
+// without a bucket starts with a full one anyway. The next sweep happens
+// once the number of buckets has doubled, so sweeping is cheap on average.
+func (rl *RateLimiter) sweep(now time.Time) {
+	for senderID, bucket := range rl.buckets {
+		limit, ok := rl.limitOf(senderID)
+		if !ok || bucket.refilled(limit, now) >= float64(limit.Burst) {
+			delete(rl.buckets, senderID)
+		}
+	}
+	rl.sweepAt = 2 * len(rl.buckets)
+	if rl.sweepAt < minSweepBuckets {
+		rl.sweepAt = minSweepBuckets
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstPerRole(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 2, Refill: time.Hour},
+		"admin":     {Burst: 3, Refill: time.Hour},
+	})
+	limiter.AssignRole("alice", "admin")
+	limiter.AssignRole("carol", "guest")
+
+	allowed := func(sender string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if limiter.Allow(sender) {
+				count++
+			}
+		}
+		return count
+	}
+	if got := allowed("bob", 5); got != 2 {
+		t.Errorf("member messages allowed = %d, want 2", got)
+	}
+	if got := allowed("alice", 5); got != 3 {
+		t.Errorf("admin messages allowed = %d, want 3", got)
+	}
+	if got := allowed("carol", 5); got != 5 {
+		t.Errorf("messages allowed for a role without limit = %d, want 5", got)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 2, Refill: time.Minute},
+	})
+	limiter.Allow("bob")
+	limiter.Allow("bob")
+	if limiter.Allow("bob") {
+		t.Fatal("message allowed with an empty bucket")
+	}
+
+	// Pretend a refill period has passed
+	limiter.buckets["bob"].last = limiter.buckets["bob"].last.Add(-time.Minute)
+	if !limiter.Allow("bob") {
+		t.Error("message not allowed after a refill period")
+	}
+	if limiter.Allow("bob") {
+		t.Error("refill granted more than one token per period")
+	}
+}
+
+func TestRateLimiterSweepsFullBuckets(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 2, Refill: time.Minute},
+	})
+	for i := 0; i < minSweepBuckets-1; i++ {
+		limiter.Allow(fmt.Sprintf("sender-%d", i))
+	}
+	limiter.Allow("busy")
+	limiter.Allow("busy")
+	// Only the idle senders have refilled by now
+	for senderID, bucket := range limiter.buckets {
+		if senderID != "busy" {
+			bucket.last = bucket.last.Add(-time.Minute)
+		}
+	}
+
+	limiter.Allow("newcomer")
+	if got := len(limiter.buckets); got != 2 {
+		t.Fatalf("buckets after sweep = %d, want busy and newcomer", got)
+	}
+	if limiter.Allow("busy") {
+		t.Error("sweep reset the bucket of a sender that is still limited")
+	}
+}
+
+func TestMessageReceiverDropsRateLimitedMessages(t *testing.T) {
+	bus := NewEventBus(nil)
+	limiter := NewRateLimiter(map[string]RateLimit{
+		DefaultRole: {Burst: 2, Refill: time.Hour},
+	})
+	(&MessageReceiver{eventBus: bus, limiter: limiter}).Start()
+	created := make(chan Event, 10)
+	bus.Subscribe("messageCreate", created)
+	bob := &Client{ID: "bob", eventBus: bus}
+	notices := bob.RateLimits()
+
+	for _, content := range []string{"1", "2", "3"} {
+		bob.SendMessage(content)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-created:
+		case <-time.After(time.Second):
+			t.Fatalf("%d messages created, want 2", i)
+		}
+	}
+	select {
+	case msg := <-notices:
+		if msg.Sender != "bob" {
+			t.Errorf("notice for %s, want bob", msg.Sender)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no rateLimited notice for the third message")
+	}
+}
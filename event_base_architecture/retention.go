@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultRoom is the room of messages that were not sent to a specific room
+const DefaultRoom = "general"
+
+// roomOf returns the room a message belongs to for retention purposes.
+// Direct messages form a room per pair of users.
+func roomOf(msg Message) string {
+	if msg.Room != "" {
+		return msg.Room
+	}
+	if msg.Recipient != "" {
+		users := []string{msg.Sender, msg.Recipient}
+		sort.Strings(users)
+		return "dm:" + users[0] + ":" + users[1]
+	}
+	return DefaultRoom
+}
+
+// RetentionPolicy limits how long and how many messages are kept
+type RetentionPolicy struct {
+	MaxAge     time.Duration // zero keeps messages of any age
+	MaxPerRoom int           // zero keeps any number of messages per room
+}
+
+// PurgeRecord is an audit entry for a message removed by the compactor
+type PurgeRecord struct {
+	MessageID string
+	Room      string
+	Sender    string
+	Timestamp time.Time // when the message was sent
+	PurgedAt  time.Time
+	Reason    string // "maxAge" or "maxPerRoom"
+}
+
+// DefaultAuditSize is the number of purge records a compactor keeps by default
+const DefaultAuditSize = 10000
+
+// Compactor applies a retention policy to the messages of a MessageSaver.
+// Rooms and senders under legal hold are never purged.
+type Compactor struct {
+	saver  *MessageSaver
+	policy RetentionPolicy
+	clock  Clock
+
+	roomHolds   map[string]bool
+	senderHolds map[string]bool
+	audit       []PurgeRecord
+	auditSize   int
+	stop        chan struct{}
+	mutex       sync.Mutex
+}
+
+// NewCompactor creates a compactor for the saver's messages
+func NewCompactor(saver *MessageSaver, policy RetentionPolicy) *Compactor {
+	return &Compactor{
+		saver:       saver,
+		policy:      policy,
+		clock:       saver.eventBus.clock,
+		roomHolds:   make(map[string]bool),
+		senderHolds: make(map[string]bool),
+		auditSize:   DefaultAuditSize,
+	}
+}
+
+// SetAuditSize changes how many of the most recent purge records are kept.
+// Negative sizes keep none, like zero.
+func (c *Compactor) SetAuditSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.auditSize = n
+	c.trimAudit()
+}
+
+// trimAudit drops the oldest purge records beyond the audit size
+func (c *Compactor) trimAudit() {
+	if excess := len(c.audit) - c.auditSize; excess > 0 {
+		c.audit = append([]PurgeRecord(nil), c.audit[excess:]...)
+	}
+}
+
+// HoldRoom exempts all messages of a room from purging
+func (c *Compactor) HoldRoom(room string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.roomHolds[room] = true
+}
+
+// ReleaseRoom lifts the legal hold of a room
+func (c *Compactor) ReleaseRoom(room string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.roomHolds, room)
+}
+
+// HoldSender exempts all messages of a sender from purging
+func (c *Compactor) HoldSender(sender string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.senderHolds[sender] = true
+}
+
+// ReleaseSender lifts the legal hold of a sender
+func (c *Compactor) ReleaseSender(sender string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.senderHolds, sender)
+}
+
+// Start runs Compact every interval until Stop is called. It does nothing
+// if the compactor is already running.
+func (c *Compactor) Start(interval time.Duration) {
+	c.mutex.Lock()
+	if c.stop != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.stop = make(chan struct{})
+	stop := c.stop
+	c.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Compact()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the background compaction started by Start
+func (c *Compactor) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+// Compact removes the messages that violate the retention policy and
+// returns the audit records of the purged messages
+func (c *Compactor) Compact() []PurgeRecord {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.saver.mutex.Lock()
+	defer c.saver.mutex.Unlock()
+
+	now := c.clock.Now()
+	messages := c.saver.messages
+	reasons := make([]string, len(messages))
+
+	// Walk from newest to oldest so the newest messages of a room are kept
+	kept := make(map[string]int)
+	for i := len(messages) - 1; i >= 0; i-- {
+		msg := messages[i]
+		room := roomOf(msg)
+		if c.roomHolds[room] || c.senderHolds[msg.Sender] {
+			continue
+		}
+		switch {
+		case c.policy.MaxAge > 0 && now.Sub(msg.Timestamp) > c.policy.MaxAge:
+			reasons[i] = "maxAge"
+		case c.policy.MaxPerRoom > 0 && kept[room] >= c.policy.MaxPerRoom:
+			reasons[i] = "maxPerRoom"
+		default:
+			kept[room]++
+		}
+	}
+
+	var purged []PurgeRecord
+	remaining := messages[:0]
+	for i, msg := range messages {
+		if reasons[i] == "" {
+			remaining = append(remaining, msg)
+			continue
+		}
+		purged = append(purged, PurgeRecord{
+			MessageID: msg.ID,
+			Room:      roomOf(msg),
+			Sender:    msg.Sender,
+			Timestamp: msg.Timestamp,
+			PurgedAt:  now,
+			Reason:    reasons[i],
+		})
+		log.Printf("Message purged: %s (%s)", msg.ID, reasons[i])
+	}
+	// Clear the tail so purged messages can be garbage collected
+	for i := len(remaining); i < len(messages); i++ {
+		messages[i] = Message{}
+	}
+	c.saver.messages = remaining
+
+	c.saver.eventBus.metrics.MessagesPurged(len(purged))
+	c.audit = append(c.audit, purged...)
+	c.trimAudit()
+	return purged
+}
+
+// AuditLog returns the records of the most recently purged messages, at
+// most the audit size, oldest first
+func (c *Compactor) AuditLog() []PurgeRecord {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := make([]PurgeRecord, len(c.audit))
+	copy(result, c.audit)
+	return result
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompactorAppliesRetentionPolicy(t *testing.T) {
+	h := NewHarness()
+	(&MessageReceiver{eventBus: h.Bus}).Start()
+	saver := &MessageSaver{eventBus: h.Bus}
+	saver.Start()
+	compactor := NewCompactor(saver, RetentionPolicy{MaxAge: time.Hour, MaxPerRoom: 2})
+
+	alice, bob := h.Client("alice"), h.Client("bob")
+	alice.SendToRoom("ops", "old")
+	bob.SendMessage("held")
+	h.Clock.Advance(2 * time.Hour)
+	for _, content := range []string{"a", "b", "c"} {
+		alice.SendToRoom("ops", content)
+	}
+	compactor.HoldSender("bob")
+
+	purged := compactor.Compact()
+	reasons := make(map[string]string)
+	for _, record := range purged {
+		reasons[record.Room+"/"+record.Sender] += record.Reason + " "
+	}
+	if len(purged) != 2 || reasons["ops/alice"] != "maxAge maxPerRoom " {
+		t.Fatalf("purged = %+v, want the old and the oldest recent ops message", purged)
+	}
+
+	var kept []string
+	for _, msg := range saver.GetMessages() {
+		kept = append(kept, msg.Content)
+	}
+	if len(kept) != 3 || kept[0] != "held" || kept[1] != "b" || kept[2] != "c" {
+		t.Errorf("kept messages = %v, want [held b c]", kept)
+	}
+
+	// Releasing the hold makes the old message eligible
+	compactor.ReleaseSender("bob")
+	if purged := compactor.Compact(); len(purged) != 1 || purged[0].Sender != "bob" || purged[0].Reason != "maxAge" {
+		t.Errorf("purged after release = %+v", purged)
+	}
+	if got := len(compactor.AuditLog()); got != 3 {
+		t.Errorf("audit records = %d, want 3", got)
+	}
+
+	// The audit only keeps the most recent records
+	compactor.SetAuditSize(1)
+	if audit := compactor.AuditLog(); len(audit) != 1 || audit[0].Sender != "bob" {
+		t.Errorf("bounded audit = %+v, want bob's record", audit)
+	}
+}
+
+func TestCompactorHoldsRoomsAndDirectMessages(t *testing.T) {
+	h := NewHarness()
+	(&MessageReceiver{eventBus: h.Bus}).Start()
+	saver := &MessageSaver{eventBus: h.Bus}
+	saver.Start()
+	compactor := NewCompactor(saver, RetentionPolicy{MaxPerRoom: 1})
+
+	alice, bob := h.Client("alice"), h.Client("bob")
+	for _, content := range []string{"1", "2"} {
+		alice.SendToRoom("legal", content)
+		alice.SendMessage(content)
+	}
+	h.Bus.Publish(Event{Type: "messageCreate", Payload: Message{ID: "dm-1", Sender: "bob", Recipient: "alice"}})
+	h.Bus.Publish(Event{Type: "messageCreate", Payload: Message{ID: "dm-2", Sender: "alice", Recipient: "bob"}})
+	bob.SendMessage("3")
+	compactor.HoldRoom("legal")
+
+	var rooms []string
+	for _, record := range compactor.Compact() {
+		rooms = append(rooms, record.Room)
+	}
+	if len(rooms) != 3 || rooms[0] != DefaultRoom || rooms[1] != DefaultRoom || rooms[2] != "dm:alice:bob" {
+		t.Errorf("purged rooms = %v, want two of %s and one of dm:alice:bob", rooms, DefaultRoom)
+	}
+	if got := len(saver.GetMessages()); got != 4 {
+		t.Errorf("kept messages = %d, want both held and the newest of each other room", got)
+	}
+}
+
+func TestCompactorAuditSizeAndRestart(t *testing.T) {
+	h := NewHarness()
+	saver := &MessageSaver{eventBus: h.Bus}
+	compactor := NewCompactor(saver, RetentionPolicy{MaxAge: time.Hour})
+	saver.messages = []Message{{ID: "1"}, {ID: "2"}}
+
+	compactor.SetAuditSize(-1)
+	if purged := compactor.Compact(); len(purged) != 2 {
+		t.Fatalf("purged = %+v, want both messages", purged)
+	}
+	if audit := compactor.AuditLog(); len(audit) != 0 {
+		t.Errorf("audit with a negative size = %+v, want none", audit)
+	}
+
+	// Starting twice runs a single loop, which one Stop ends
+	compactor.Start(time.Hour)
+	compactor.Start(time.Hour)
+	compactor.Stop()
+	compactor.Stop()
+	if compactor.stop != nil {
+		t.Error("compactor still running after Stop")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// maxBatchProjects caps the number of projects of one batchGet request.
+const maxBatchProjects = 100
+
+// maxBatchBodyBytes limits the size of batchGet request bodies.
+const maxBatchBodyBytes = 64 << 10
+
+// batchFetchConcurrency bounds the upstream requests made for one batch.
+const batchFetchConcurrency = 8
+
+// batchRequest is the body of POST /projects:batchGet.
+type batchRequest struct {
+	Projects []struct {
+		Org  string `json:"org"`
+		Repo string `json:"repo"`
+	} `json:"projects"`
+}
+
+// batchResult is the outcome for one project of a batch, either the project
+// or the error GET /project/{org}/{repo} would have returned.
+type batchResult struct {
+	Status  int             `json:"status"`
+	Project json.RawMessage `json:"project,omitempty"`
+	Error   *errorResponse  `json:"error,omitempty"`
+}
+
+// batchResponse maps "org/repo" to the result for that project.
+type batchResponse struct {
+	Results map[string]batchResult `json:"results"`
+}
+
+// batchGetHandler implements POST /projects:batchGet. Projects are resolved
+// from the local cache, then with a single central cache read, and the rest from
+// GitHub with a bounded number of concurrent requests. A failure for one
+// project does not fail the batch. Fetches and refreshes run in ctx, the
+// server's context, as they are shared with other requests.
+func batchGetHandler(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req batchRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Body must be a JSON object with a projects list")
+			return
+		}
+		if len(req.Projects) == 0 || len(req.Projects) > maxBatchProjects {
+			writeJSONError(w, http.StatusBadRequest, "bad_request",
+				fmt.Sprintf("Between 1 and %d projects are required", maxBatchProjects))
+			return
+		}
+
+		type project struct{ org, repo, key string }
+		var pending []project
+		seen := make(map[string]bool)
+		for _, p := range req.Projects {
+			if p.Org == "" || p.Repo == "" {
+				writeJSONError(w, http.StatusBadRequest, "bad_request", "Missing organization or repository")
+				return
+			}
+			name := p.Org + "/" + p.Repo
+			if !seen[name] {
+				seen[name] = true
+				pending = append(pending, project{p.Org, p.Repo, projectKey(p.Org, p.Repo)})
+			}
+		}
+
+		var mu sync.Mutex
+		results := make(map[string]batchResult, len(pending))
+		setResult := func(p project, body []byte, err error) {
+			result := batchResult{Status: http.StatusOK, Project: body}
+			if err != nil {
+				status, resp := errorStatus(err)
+				result = batchResult{Status: status, Error: &resp}
+			}
+			mu.Lock()
+			results[p.org+"/"+p.repo] = result
+			mu.Unlock()
+		}
+		// resolve sets the result from a cached value and reports whether it could.
+		resolve := func(p project, value string) bool {
+			cached, err := decodeProject(value)
+			if err != nil || cached.Deleted || cached.Outdated {
+				return false
+			}
+			if cached.NotFound {
+				setResult(p, nil, ErrProjectNotFound)
+				return true
+			}
+			if cached.stale(cache.opts.FreshFor) {
+				scheduleRefresh(ctx, be, cache, upstream, p.org, p.repo, p.key, cached, false)
+			}
+			setResult(p, cached.body(), nil)
+			return true
+		}
+
+		// 1. Local cache.
+		missed := pending[:0:0]
+		for _, p := range pending {
+			if value, ok := cache.Get(p.key); !ok || !resolve(p, value) {
+				missed = append(missed, p)
+			}
+		}
+		if len(missed) == 0 {
+			writeJSON(w, http.StatusOK, batchResponse{Results: results})
+			return
+		}
+		keys := make([]string, len(missed))
+		for i, p := range missed {
+			keys[i] = p.key
+		}
+
+		// 2. Central cache, projects and not-found markers in one read each.
+		values, err := be.Projects(r.Context(), keys...)
+		if err != nil {
+			log.Printf("Central cache error: %v", err)
+			values = make([]string, len(keys))
+		}
+		// Projects loaded from the central cache or GitHub are counted for hot warm-ups.
+		var loaded []string
+		pending = missed[:0:0]
+		for i, p := range missed {
+			if value := values[i]; value != "" {
+				cacheProject(cache, p.key, value, 0)
+				if resolve(p, value) {
+					loaded = append(loaded, p.key)
+					continue
+				}
+			}
+			pending = append(pending, p)
+		}
+		if len(pending) > 0 {
+			missingKeys := make([]string, len(pending))
+			for i, p := range pending {
+				missingKeys[i] = p.key
+			}
+			markers, err := be.Missing(r.Context(), missingKeys...)
+			if err != nil {
+				log.Printf("Central cache error: %v", err)
+				markers = make([]string, len(pending))
+			}
+			missed = pending
+			pending = missed[:0:0]
+			for i, p := range missed {
+				if value := markers[i]; value != "" && cacheMissing(cache, p.key, value) && resolve(p, value) {
+					continue
+				}
+				pending = append(pending, p)
+			}
+		}
+
+		// 3. GitHub, shared with concurrent requests for the same keys.
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, batchFetchConcurrency)
+		for _, p := range pending {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				fetched, err, _ := projectFetches.Do(p.key, func() (cachedProject, error) {
+					return fetchProject(ctx, be, cache, upstream, p.org, p.repo, p.key)
+				})
+				setResult(p, fetched.body(), err)
+				if err == nil {
+					mu.Lock()
+					loaded = append(loaded, p.key)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(loaded) > 0 {
+			recordHotKeys(ctx, be, cache, loaded...)
+		}
+
+		writeJSON(w, http.StatusOK, batchResponse{Results: results})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchGetHandler(t *testing.T) {
+	mr, be := newTestRedis(t)
+	ctx := context.Background()
+	upstream := newFakeUpstream(map[string]string{"org/fetched": `{"name":"fetched"}`})
+	cache := NewLocalCache(CacheOptions{})
+	handler := batchGetHandler(ctx, be, cache, upstream)
+
+	cacheProject(cache, "project:org:local", cachedProject{Data: json.RawMessage(`{"name":"local"}`), FetchedAt: time.Now()}.encode(), 0)
+	mr.HSet(projectsKey, "project:org:central", cachedProject{Data: json.RawMessage(`{"name":"central"}`), Version: 1, FetchedAt: time.Now()}.encode())
+	storeMissing(ctx, be, cache, "project:org:gone")
+	cache.Delete("project:org:gone")
+
+	body := `{"projects":[{"org":"org","repo":"local"},{"org":"org","repo":"central"},{"org":"org","repo":"fetched"},
+		{"org":"org","repo":"gone"},{"org":"org","repo":"unknown"},{"org":"org","repo":"local"}]}`
+	rec := serve(handler, http.MethodPost, "/projects:batchGet", "/projects:batchGet", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /projects:batchGet = %d %s", rec.Code, rec.Body.String())
+	}
+	var resp batchResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if len(resp.Results) != 5 {
+		t.Fatalf("results = %+v, want one per distinct project", resp.Results)
+	}
+	for name, want := range map[string]string{"org/local": `{"name":"local"}`, "org/central": `{"name":"central"}`, "org/fetched": `{"name":"fetched"}`} {
+		if got := resp.Results[name]; got.Status != http.StatusOK || string(got.Project) != want {
+			t.Errorf("%s = %d %s, want %s", name, got.Status, got.Project, want)
+		}
+	}
+	for _, name := range []string{"org/gone", "org/unknown"} {
+		if got := resp.Results[name]; got.Status != http.StatusNotFound || got.Error == nil || got.Error.Error != "not_found" {
+			t.Errorf("%s = %+v, want not_found", name, got)
+		}
+	}
+	// Only the projects in neither cache went to GitHub.
+	if calls := upstream.Calls(); calls != 2 {
+		t.Fatalf("upstream got %d requests, want 2", calls)
+	}
+	if _, ok := cache.Get("project:org:central"); !ok {
+		t.Fatal("project from Redis was not cached locally")
+	}
+
+	// Only projects that had to be loaded count for hot warm-ups.
+	backgroundTasks.Wait()
+	hot, _ := mr.ZMembers(hotKeysKey)
+	if strings.Join(hot, ",") != "project:org:central,project:org:fetched" {
+		t.Fatalf("hot keys = %q", hot)
+	}
+}
+
+func TestBatchGetHandlerRejectsBadRequests(t *testing.T) {
+	_, be := newTestRedis(t)
+	handler := batchGetHandler(context.Background(), be, NewLocalCache(CacheOptions{}), newFakeUpstream(nil))
+
+	for _, body := range []string{
+		`not json`,
+		`{"projects":[]}`,
+		`{"projects":[{"org":"org"}]}`,
+		`{"projects":[` + strings.Repeat(`{"org":"o","repo":"r"},`, maxBatchProjects) + `{"org":"o","repo":"r"}]}`,
+	} {
+		rec := serve(handler, http.MethodPost, "/projects:batchGet", "/projects:batchGet", body)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %.40s... = %d, want 400", body, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Warm-up modes of the local cache, see bootstrapCache.
+const (
+	warmupFull = "full" // load every project
+	warmupHot  = "hot"  // load the most requested projects, the rest on demand
+)
+
+// defaultWarmupKeys is the number of projects loaded by a hot warm-up.
+const defaultWarmupKeys = 1000
+
+// bootstrapBatch is the number of projects requested at a time, e.g. per
+// HSCAN or HMGET, so that loading a large data set never blocks Redis for long.
+const bootstrapBatch = 500
+
+// hotKeysKey is the Redis sorted set counting how often pods had to load a
+// project from Redis or upstream. Its top entries are warmed in hot mode.
+const hotKeysKey = "projects:hot"
+
+// The hot keys set is trimmed to hotKeysKept times the warm-up keys entries,
+// so that projects just below the top can still climb into it.
+const hotKeysKept = 10
+
+// bootstrapCache loads existing project data from the central cache into the local cache.
+// In hot mode only the most requested projects are loaded, as many as the
+// cache's WarmupKeys option; the index covers all projects either way. It returns the update sequence number
+// the loaded data is at least as new as. The data is read from a replica if
+// there is one; the sequence number is read from the same server first, so a
+// lagging replica cannot hide updates.
+func bootstrapCache(ctx context.Context, be *Backend, cache *LocalCache) (uint64, error) {
+	start := time.Now()
+	var seq uint64
+	var loaded int
+	err := be.View(func(v StoreView) error {
+		var err error
+		if seq, err = v.UpdateSeq(ctx); err != nil {
+			return err
+		}
+		if cache.opts.WarmupMode == warmupHot {
+			loaded, err = warmHotKeys(ctx, v, cache)
+			return err
+		}
+		loaded = 0
+		return v.ScanProjects(ctx, func(batch map[string]string) error {
+			for key, value := range batch {
+				cacheProject(cache, key, value, 0)
+			}
+			loaded += len(batch)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	cache.Index().MarkComplete()
+	log.Printf("Loaded %d projects into the local cache in %s (%s warm-up).",
+		loaded, time.Since(start).Round(time.Millisecond), cache.opts.WarmupMode)
+	return seq, nil
+}
+
+// warmHotKeys fills the local index from the stored index terms and loads the
+// most requested projects. It returns the number of projects loaded.
+func warmHotKeys(ctx context.Context, v StoreView, cache *LocalCache) (int, error) {
+	err := v.ScanTerms(ctx, func(batch map[string][]string) error {
+		for key, terms := range batch {
+			cache.Index().Update(key, terms)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	hot, err := v.HotKeys(ctx, cache.opts.WarmupKeys)
+	if err != nil {
+		return 0, err
+	}
+	loaded := 0
+	for start := 0; start < len(hot); start += bootstrapBatch {
+		batch := hot[start:min(start+bootstrapBatch, len(hot))]
+		values, err := v.Projects(ctx, batch...)
+		if err != nil {
+			return loaded, err
+		}
+		for i, value := range values {
+			if value != "" {
+				cacheProject(cache, batch[i], value, 0)
+				loaded++
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// recordHotKeys counts in the background requests for existing projects
+// that had to be loaded into the local cache, so that hot mode warm-ups load
+// them. Misses for unknown projects are not counted. The hot keys set is
+// trimmed in the same step.
+func recordHotKeys(ctx context.Context, be *Backend, cache *LocalCache, keys ...string) {
+	limit := hotKeysKept * cache.opts.WarmupKeys
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		if err := be.CountRequests(ctx, limit, keys...); err != nil {
+			log.Printf("Error counting project requests: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBootstrapCacheLoadsAllProjectsInBatches(t *testing.T) {
+	mr, be := newTestRedis(t)
+	n := 3*bootstrapBatch + 7
+	for i := 0; i < n; i++ {
+		mr.HSet(projectsKey, fmt.Sprintf("project:org:%d", i), cachedProject{Version: uint64(i + 1)}.encode())
+	}
+	mr.Set(updateSeqKey(defaultUpdatesChannel), "5")
+
+	cache := NewLocalCache(CacheOptions{})
+	seq, err := bootstrapCache(context.Background(), be, cache)
+	if err != nil || seq != 5 {
+		t.Fatalf("bootstrapCache = %d, %v, want 5", seq, err)
+	}
+	if entries := cache.Stats().Entries; entries != n {
+		t.Fatalf("cache holds %d projects, want %d", entries, n)
+	}
+	if !cache.Index().Complete() {
+		t.Fatal("index was not marked complete")
+	}
+}
+
+func TestBootstrapCacheHotMode(t *testing.T) {
+	mr, be := newTestRedis(t)
+	for i, name := range []string{"a", "b", "c"} {
+		key := "project:org:" + name
+		mr.HSet(projectsKey, key, cachedProject{Data: json.RawMessage(`{"language":"Go"}`), Version: 1}.encode())
+		mr.HSet(projectTermsKey, key, "owner:org\nlang:go")
+		mr.ZAdd(hotKeysKey, float64(i), key)
+	}
+
+	cache := NewLocalCache(CacheOptions{WarmupMode: warmupHot, WarmupKeys: 2})
+	if _, err := bootstrapCache(context.Background(), be, cache); err != nil {
+		t.Fatalf("bootstrapCache: %v", err)
+	}
+	for key, want := range map[string]bool{"project:org:a": false, "project:org:b": true, "project:org:c": true} {
+		if _, ok := cache.Peek(key); ok != want {
+			t.Errorf("%s loaded = %v, want %v", key, ok, want)
+		}
+	}
+	// The index covers the projects that were not loaded too.
+	if keys := cache.Index().Query([]string{"lang:go"}); len(keys) != 3 {
+		t.Fatalf("index query = %v, want all 3 projects", keys)
+	}
+}
+
+func TestRecordHotKeysTrimsTheSet(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{WarmupKeys: 1})
+	limit := hotKeysKept * cache.opts.WarmupKeys
+
+	recordHotKeys(context.Background(), be, cache, "popular")
+	for i := 0; i < limit+5; i++ {
+		recordHotKeys(context.Background(), be, cache, "popular", fmt.Sprintf("key-%d", i))
+	}
+	backgroundTasks.Wait()
+
+	members, err := mr.ZMembers(hotKeysKey)
+	if err != nil || len(members) != limit {
+		t.Fatalf("hot keys set holds %d members, %v, want %d", len(members), err, limit)
+	}
+	if score, _ := mr.ZScore(hotKeysKey, "popular"); score != float64(limit+6) {
+		t.Fatalf("popular score = %v, want %d", score, limit+6)
+	}
+}
+
+func TestGetProjectHandlerCountsLoadedProjects(t *testing.T) {
+	mr, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"org/fetched": `{"id":2}`})
+	handler := getProjectHandler(context.Background(), be, NewLocalCache(CacheOptions{}), upstream)
+	mr.HSet(projectsKey, "project:org:stored", cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now()}.encode())
+
+	for _, path := range []string{"/project/org/stored", "/project/org/stored", "/project/org/fetched", "/project/org/missing"} {
+		get(handler, "/project/{org}/{repo}", path)
+	}
+	backgroundTasks.Wait()
+
+	// Local hits and unknown projects are not counted.
+	for key, want := range map[string]float64{"project:org:stored": 1, "project:org:fetched": 1} {
+		if score, err := mr.ZScore(hotKeysKey, key); err != nil || score != want {
+			t.Errorf("%s score = %v, %v, want %v", key, score, err, want)
+		}
+	}
+	if members, _ := mr.ZMembers(hotKeysKey); len(members) != 2 {
+		t.Errorf("hot keys = %v, want only the loaded projects", members)
+	}
+}
+
+func TestSubscribeForUpdatesRetriesWarmUp(t *testing.T) {
+	mr, be := newTestRedis(t)
+	// A hot keys entry of the wrong type makes the hot warm-up fail.
+	mr.Set(hotKeysKey, "broken")
+	cache := NewLocalCache(CacheOptions{WarmupMode: warmupHot})
+	status := &SyncStatus{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		subscribeForUpdates(ctx, be, cache, 0, status)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	time.Sleep(warmupRetryDelay / 2)
+	if status.bootstrapped.Load() {
+		t.Fatal("warm-up succeeded against a broken hot keys set")
+	}
+	mr.Del(hotKeysKey)
+
+	deadline := time.Now().Add(3 * warmupRetryDelay)
+	for !status.bootstrapped.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("warm-up was not retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rec := get(readyzHandler(be, status), "/readyz", "/readyz"); rec.Code != http.StatusOK {
+		t.Fatalf("GET /readyz after warm-up = %d", rec.Code)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheOptions bounds the size and lifetime of LocalCache entries and holds
+// how long the projects in it are trusted. Zero bounds mean no limit; the
+// other zero values are replaced by their defaults.
+type CacheOptions struct {
+	TTL        time.Duration // default time to live of an entry
+	MaxEntries int           // maximum number of entries
+	MaxBytes   int64         // maximum total size of keys and values
+
+	Fields               []string // stored project fields, see projectJSON
+	Compression          string   // compressNone, compressGzip or compressZstd
+	MaxInlineUpdateBytes int      // largest value sent along with a versioned update
+
+	WarmupMode   string        // warmupFull or warmupHot
+	WarmupKeys   int           // projects loaded by a hot warm-up
+	FreshFor     time.Duration // how long a fetched project is served without revalidation
+	NotFoundTTL  time.Duration // how long a repository is remembered as missing
+	TombstoneTTL time.Duration // how long a deleted key is remembered
+}
+
+// CacheStats are counters describing how the local cache performs.
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`   // entries removed to respect the size bounds
+	Expirations uint64 `json:"expirations"` // entries removed because their TTL passed
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// cacheEntry is the value stored in the LRU list.
+type cacheEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time // zero if the entry never expires
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// LocalCache is a thread-safe in-memory LRU cache with optional TTLs and size bounds.
+// The zero value is an unbounded cache without expiry.
+type LocalCache struct {
+	opts    CacheOptions
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // front is most recently used
+	bytes   int64
+	stats   CacheStats
+	now     func() time.Time
+	index   *ProjectIndex
+}
+
+// NewLocalCache creates a local cache with the given options.
+func NewLocalCache(opts CacheOptions) *LocalCache {
+	if opts.Fields == nil {
+		opts.Fields = defaultProjectFields
+	}
+	if opts.Compression == "" {
+		opts.Compression = compressNone
+	}
+	if opts.MaxInlineUpdateBytes == 0 {
+		opts.MaxInlineUpdateBytes = defaultMaxInlineUpdateBytes
+	}
+	if opts.WarmupMode == "" {
+		opts.WarmupMode = warmupFull
+	}
+	if opts.WarmupKeys == 0 {
+		opts.WarmupKeys = defaultWarmupKeys
+	}
+	if opts.FreshFor == 0 {
+		opts.FreshFor = defaultFreshFor
+	}
+	if opts.NotFoundTTL == 0 {
+		opts.NotFoundTTL = defaultNotFoundTTL
+	}
+	if opts.TombstoneTTL == 0 {
+		opts.TombstoneTTL = defaultTombstoneTTL
+	}
+	return &LocalCache{opts: opts}
+}
+
+func (c *LocalCache) init() {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.index == nil {
+		c.index = NewProjectIndex()
+	}
+}
+
+// Index returns the secondary index of the projects known to this pod. It is
+// maintained alongside the cache but not subject to eviction.
+func (c *LocalCache) Index() *ProjectIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	return c.index
+}
+
+// Get returns the value for a given key.
+func (c *LocalCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expiresAt.IsZero() && !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return "", false
+	}
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	return entry.value, true
+}
+
+// Peek returns the value for a key like Get, but neither counts a hit or miss
+// nor marks the entry as recently used.
+func (c *LocalCache) Peek(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expiresAt.IsZero() && !c.now().Before(entry.expiresAt) {
+		return "", false
+	}
+	return entry.value, true
+}
+
+// Set stores the key/value pair in the cache using the default TTL.
+func (c *LocalCache) Set(key, value string) {
+	c.SetWithTTL(key, value, c.opts.TTL)
+}
+
+// SetWithTTL stores the key/value pair in the cache for ttl, or forever if ttl is zero.
+func (c *LocalCache) SetWithTTL(key, value string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+	c.set(key, value, ttl)
+}
+
+// SetIf stores the key/value pair for ttl only if cond returns true for the
+// current value; exists is false if the key is absent or expired. The check
+// and the write are atomic. SetIf reports whether the value was stored.
+func (c *LocalCache) SetIf(key, value string, ttl time.Duration, cond func(current string, exists bool) bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	var current string
+	exists := false
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.expiresAt.IsZero() || c.now().Before(entry.expiresAt) {
+			current, exists = entry.value, true
+		}
+	}
+	if !cond(current, exists) {
+		return false
+	}
+	c.set(key, value, ttl)
+	return true
+}
+
+func (c *LocalCache) set(key, value string, ttl time.Duration) {
+	entry := &cacheEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expiresAt = c.now().Add(ttl)
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+
+	// Evict least recently used entries until the bounds hold again,
+	// but never the entry that was just stored.
+	for c.lru.Len() > 1 && c.overLimit() {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Delete removes a key from the cache.
+func (c *LocalCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.init()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *LocalCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
+
+func (c *LocalCache) overLimit() bool {
+	if c.opts.MaxEntries > 0 && c.lru.Len() > c.opts.MaxEntries {
+		return true
+	}
+	return c.opts.MaxBytes > 0 && c.bytes > c.opts.MaxBytes
+}
+
+func (c *LocalCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache whose clock only moves when the returned function is called.
+func newTestCache(opts CacheOptions) (*LocalCache, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewLocalCache(opts)
+	c.now = func() time.Time { return now }
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLocalCacheTTL(t *testing.T) {
+	c, advance := newTestCache(CacheOptions{TTL: time.Minute})
+	c.Set("a", "1")
+	c.SetWithTTL("b", "2", 0)
+
+	advance(59 * time.Second)
+	if v, ok := c.Get("a"); !ok || v != "1" {
+		t.Fatalf("Get(a) before expiry = %q, %v", v, ok)
+	}
+	advance(time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Get(a) after expiry found the entry")
+	}
+	if v, ok := c.Get("b"); !ok || v != "2" {
+		t.Fatalf("Get(b) without TTL = %q, %v", v, ok)
+	}
+
+	stats := c.Stats()
+	if stats.Expirations != 1 || stats.Entries != 1 {
+		t.Fatalf("stats = %+v, want 1 expiration and 1 entry", stats)
+	}
+}
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, _ := newTestCache(CacheOptions{MaxEntries: 2})
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Get("a") // b is now the least recently used entry
+	c.Set("c", "3")
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Fatalf("%s should still be cached", key)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Fatalf("stats = %+v, want 1 eviction and 2 entries", stats)
+	}
+}
+
+func TestLocalCacheMaxBytes(t *testing.T) {
+	c, _ := newTestCache(CacheOptions{MaxBytes: 10})
+	c.Set("a", "1234") // 5 bytes
+	c.Set("b", "1234") // 10 bytes
+	if stats := c.Stats(); stats.Bytes != 10 || stats.Evictions != 0 {
+		t.Fatalf("stats = %+v, want 10 bytes and no evictions", stats)
+	}
+
+	c.Set("a", "12") // replacing shrinks the total to 8 bytes
+	if stats := c.Stats(); stats.Bytes != 8 || stats.Entries != 2 {
+		t.Fatalf("stats after replace = %+v, want 8 bytes in 2 entries", stats)
+	}
+
+	c.Set("c", "1234") // 13 bytes, b is the least recently used
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b should have been evicted")
+	}
+	if stats := c.Stats(); stats.Bytes != 8 {
+		t.Fatalf("bytes = %d, want 8", stats.Bytes)
+	}
+
+	// An entry larger than the bound is still kept on its own.
+	c.Set("big", "0123456789")
+	if v, ok := c.Get("big"); !ok || v != "0123456789" {
+		t.Fatalf("Get(big) = %q, %v", v, ok)
+	}
+	if stats := c.Stats(); stats.Entries != 1 {
+		t.Fatalf("entries = %d, want 1", stats.Entries)
+	}
+}
+
+func TestLocalCacheStats(t *testing.T) {
+	var c LocalCache // the zero value is usable
+	c.Set("a", "1")
+	c.Get("a")
+	c.Get("a")
+	c.Get("missing")
+	c.Delete("a")
+	c.Get("a")
+
+	want := CacheStats{Hits: 2, Misses: 2}
+	if stats := c.Stats(); stats != want {
+		t.Fatalf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestLocalCacheSetIf(t *testing.T) {
+	c, advance := newTestCache(CacheOptions{})
+	c.SetWithTTL("a", "1", time.Minute)
+
+	var seen []string
+	record := func(current string, exists bool) bool {
+		if exists {
+			seen = append(seen, current)
+		} else {
+			seen = append(seen, "<none>")
+		}
+		return current != "2"
+	}
+	if !c.SetIf("a", "2", time.Minute, record) {
+		t.Fatal("SetIf refused to replace 1")
+	}
+	if c.SetIf("a", "3", time.Minute, record) {
+		t.Fatal("SetIf replaced 2")
+	}
+	advance(time.Minute)
+	if !c.SetIf("a", "4", 0, record) {
+		t.Fatal("SetIf refused to replace an expired entry")
+	}
+	if want := []string{"1", "2", "<none>"}; strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Fatalf("cond saw %v, want %v", seen, want)
+	}
+	if v, ok := c.Get("a"); !ok || v != "4" {
+		t.Fatalf("Get(a) = %q, %v", v, ok)
+	}
+}
+
+func TestLocalCachePeek(t *testing.T) {
+	c, advance := newTestCache(CacheOptions{MaxEntries: 2})
+	c.Set("a", "1")
+	c.SetWithTTL("b", "2", time.Minute)
+
+	if v, ok := c.Peek("a"); !ok || v != "1" {
+		t.Fatalf("Peek(a) = %q, %v", v, ok)
+	}
+	if stats := c.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Fatalf("Peek counted lookups: %+v", stats)
+	}
+	// Peek does not make "a" recently used, so it is evicted first.
+	c.Set("c", "3")
+	if _, ok := c.Peek("a"); ok {
+		t.Fatal("peeked entry was not evicted as least recently used")
+	}
+	advance(time.Minute)
+	if _, ok := c.Peek("b"); ok {
+		t.Fatal("Peek returned an expired entry")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// flightGroup coalesces concurrent calls for the same key into one call,
+// so a burst of cache misses triggers a single upstream fetch per pod.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[T]
+}
+
+// flightCall is an in-flight or completed call of a flightGroup.
+type flightCall[T any] struct {
+	wg  sync.WaitGroup
+	val T
+	err error
+}
+
+// Do runs fn once for all concurrent callers with the same key and returns its result to all of them.
+// shared reports whether the result was produced by another caller.
+func (g *flightGroup[T]) Do(key string, fn func() (T, error)) (val T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := &flightCall[T]{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return call.val, call.err, false
+}
+
+// fetchLockTTL bounds how long a pod may hold the fetch lock of a key; it is
+// slightly longer than the GitHub client timeout.
+const fetchLockTTL = 15 * time.Second
+
+// fetchLockPoll is how often waiting pods check whether the lock holder finished.
+const fetchLockPoll = 100 * time.Millisecond
+
+// fetchLockKey returns the Redis key guarding the upstream fetch of a cache key.
+func fetchLockKey(key string) string {
+	return "lock:" + key
+}
+
+// acquireFetchLock tries to become the only pod fetching key from upstream.
+// It returns the token needed to release the lock, or "" if another pod holds it.
+func acquireFetchLock(ctx context.Context, be *Backend, key string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	ok, err := be.TryLock(ctx, key, token, fetchLockTTL)
+	if err != nil || !ok {
+		return "", err
+	}
+	return token, nil
+}
+
+// releaseFetchLock releases a lock obtained from acquireFetchLock.
+func releaseFetchLock(ctx context.Context, be *Backend, key, token string) error {
+	return be.Unlock(ctx, key, token)
+}
+
+// waitForFetch waits while another pod holds the fetch lock of key and returns
+// the value or not-found marker it stored in Redis. ok is false if the lock
+// went away without a value, e.g. because the other pod failed, so the caller
+// should fetch itself. It gives up early if ctx is done.
+func waitForFetch(ctx context.Context, be *Backend, key string) (value string, ok bool) {
+	deadline := time.Now().Add(fetchLockTTL)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(fetchLockPoll):
+		case <-ctx.Done():
+			return "", false
+		}
+
+		// Check the lock before the value: the holder stores the value
+		// before it releases the lock, so once the lock is gone the value
+		// can be read.
+		held, err := be.Locked(ctx, key)
+		if err != nil {
+			return "", false
+		}
+		value, err := be.Project(ctx, key)
+		if err == nil && value != "" {
+			return value, true
+		}
+		markers, err := be.Missing(ctx, key)
+		if err == nil && markers[0] != "" {
+			return markers[0], true
+		}
+		if !held {
+			return "", false
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupCoalescesConcurrentCalls(t *testing.T) {
+	var g flightGroup[[]byte]
+	var calls int32
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("value"), nil
+	}
+
+	const callers = 10
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err, s := g.Do("key", fn)
+			if err != nil || string(val) != "value" {
+				t.Errorf("Do = %q, %v", val, err)
+			}
+			if s {
+				atomic.AddInt32(&shared, 1)
+			}
+		}()
+	}
+
+	// Give every caller time to join the call in flight before it finishes.
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("fn ran %d times, want 1", calls)
+	}
+	if shared != callers-1 {
+		t.Fatalf("%d callers shared the result, want %d", shared, callers-1)
+	}
+}
+
+func TestFlightGroupForgetsFinishedCalls(t *testing.T) {
+	var g flightGroup[[]byte]
+	calls := 0
+	errUpstream := errors.New("upstream failed")
+	fn := func() ([]byte, error) {
+		calls++
+		return nil, errUpstream
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err, shared := g.Do("key", fn); err != errUpstream || shared {
+			t.Fatalf("Do = %v, shared %v", err, shared)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("fn ran %d times, want 2", calls)
+	}
+}
+
+func TestFetchLockIsExclusive(t *testing.T) {
+	mr, be := newTestRedis(t)
+
+	token, err := acquireFetchLock(context.Background(), be, "project:org:repo")
+	if err != nil || token == "" {
+		t.Fatalf("acquireFetchLock = %q, %v", token, err)
+	}
+	if ttl := mr.TTL(fetchLockKey("project:org:repo")); ttl != fetchLockTTL {
+		t.Fatalf("lock TTL = %v, want %v", ttl, fetchLockTTL)
+	}
+	if other, err := acquireFetchLock(context.Background(), be, "project:org:repo"); err != nil || other != "" {
+		t.Fatalf("second acquireFetchLock = %q, %v, want no lock", other, err)
+	}
+
+	// Only the holder can release the lock.
+	if err := releaseFetchLock(context.Background(), be, "project:org:repo", "someone-else"); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists(fetchLockKey("project:org:repo")) {
+		t.Fatal("lock released with the wrong token")
+	}
+	if err := releaseFetchLock(context.Background(), be, "project:org:repo", token); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := acquireFetchLock(context.Background(), be, "project:org:repo"); err != nil || token == "" {
+		t.Fatalf("acquireFetchLock after release = %q, %v", token, err)
+	}
+}
+
+func TestWaitForFetch(t *testing.T) {
+	mr, be := newTestRedis(t)
+
+	token, err := acquireFetchLock(context.Background(), be, "project:org:repo")
+	if err != nil || token == "" {
+		t.Fatalf("acquireFetchLock = %q, %v", token, err)
+	}
+	go func() {
+		time.Sleep(2 * fetchLockPoll)
+		mr.HSet("projects", "project:org:repo", `{"id":1}`)
+		releaseFetchLock(context.Background(), be, "project:org:repo", token)
+	}()
+	if value, ok := waitForFetch(context.Background(), be, "project:org:repo"); !ok || value != `{"id":1}` {
+		t.Fatalf("waitForFetch = %q, %v", value, ok)
+	}
+
+	// A holder that gives up without storing a value lets the waiter fetch itself.
+	token, err = acquireFetchLock(context.Background(), be, "project:org:other")
+	if err != nil || token == "" {
+		t.Fatalf("acquireFetchLock = %q, %v", token, err)
+	}
+	go func() {
+		time.Sleep(fetchLockPoll)
+		releaseFetchLock(context.Background(), be, "project:org:other", token)
+	}()
+	if value, ok := waitForFetch(context.Background(), be, "project:org:other"); ok {
+		t.Fatalf("waitForFetch = %q, want no value", value)
+	}
+}
+
+// TestFetchProjectWaitsForLockHolder checks that pods which miss while another
+// pod holds the fetch lock use its result instead of querying upstream.
+func TestFetchProjectWaitsForLockHolder(t *testing.T) {
+	mr, be := newTestRedis(t)
+	const key = "project:org:repo"
+
+	token, err := acquireFetchLock(context.Background(), be, key)
+	if err != nil || token == "" {
+		t.Fatalf("acquireFetchLock = %q, %v", token, err)
+	}
+
+	upstream := newFakeUpstream(nil)
+	const pods = 5
+	var wg sync.WaitGroup
+	caches := make([]*LocalCache, pods)
+	for i := range caches {
+		caches[i] = NewLocalCache(CacheOptions{})
+		wg.Add(1)
+		go func(cache *LocalCache) {
+			defer wg.Done()
+			p, err := fetchProject(context.Background(), be, cache, upstream, "org", "repo", key)
+			if err != nil || string(p.body()) != `{"id":1}` {
+				t.Errorf("fetchProject = %q, %v", p.body(), err)
+			}
+		}(caches[i])
+	}
+
+	time.Sleep(2 * fetchLockPoll)
+	mr.HSet("projects", key, `{"id":1}`)
+	releaseFetchLock(context.Background(), be, key, token)
+	wg.Wait()
+
+	if calls := upstream.Calls(); calls != 0 {
+		t.Fatalf("upstream got %d requests, want 0", calls)
+	}
+	for i, cache := range caches {
+		if value, ok := cache.Get(key); !ok || value != `{"id":1}` {
+			t.Fatalf("pod %d cached %q, %v", i, value, ok)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the server. Values are taken, in increasing
+// order of precedence, from the defaults, an optional YAML file, environment
+// variables and command line flags.
+type Config struct {
+	ListenAddr      string        `yaml:"listen_addr"`
+	DrainDelay      time.Duration `yaml:"drain_delay"`      // how long to keep serving while reporting unready on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // deadline for in-flight requests after the drain delay
+	Backend         string        `yaml:"backend"`          // "redis", or "memory" for a single node
+	Redis           RedisConfig   `yaml:"redis"`
+	GitHub          GitHubConfig  `yaml:"github"`
+	Cache           CacheConfig   `yaml:"cache"`
+	Channels        ChannelConfig `yaml:"channels"`
+}
+
+// RedisConfig configures the connection to the central cache.
+type RedisConfig struct {
+	Mode       string   `yaml:"mode"`        // "standalone", "sentinel" or "cluster"
+	Addr       string   `yaml:"addr"`        // master, in standalone mode
+	Replicas   []string `yaml:"replicas"`    // read replicas, in standalone mode
+	Addrs      []string `yaml:"addrs"`       // sentinels or cluster seed nodes
+	MasterName string   `yaml:"master_name"` // in sentinel mode
+	Password   string   `yaml:"password"`
+	DB         int      `yaml:"db"`
+	TLS        bool     `yaml:"tls"`
+}
+
+// GitHubConfig configures the upstream GitHub API.
+type GitHubConfig struct {
+	BaseURL       string `yaml:"base_url"`
+	Token         string `yaml:"token"`
+	WebhookSecret string `yaml:"webhook_secret"` // empty disables POST /webhooks/github
+}
+
+// CacheConfig configures the local cache and how long cached data is trusted.
+type CacheConfig struct {
+	TTL          time.Duration `yaml:"ttl"`
+	MaxEntries   int           `yaml:"max_entries"`
+	MaxBytes     int64         `yaml:"max_bytes"`
+	Fields       []string      `yaml:"fields"`      // stored project fields, ["*"] keeps all
+	Compression  string        `yaml:"compression"` // "none", "gzip" or "zstd"
+	Warmup       string        `yaml:"warmup"`      // "full" or "hot"
+	WarmupKeys   int           `yaml:"warmup_keys"` // projects loaded by a hot warm-up
+	FreshFor     time.Duration `yaml:"fresh_for"`
+	NotFoundTTL  time.Duration `yaml:"not_found_ttl"`
+	TombstoneTTL time.Duration `yaml:"tombstone_ttl"`
+}
+
+// ChannelConfig configures the Redis Pub/Sub channels.
+type ChannelConfig struct {
+	Updates        string `yaml:"updates"`
+	MaxInlineBytes int    `yaml:"max_inline_bytes"` // larger values are not sent with updates
+}
+
+// defaultConfig returns the settings used when nothing is configured.
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8080",
+		DrainDelay:      15 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
+		Backend:         backendRedis,
+		Redis: RedisConfig{
+			Mode: redisStandalone,
+			Addr: "localhost:6379",
+		},
+		GitHub: GitHubConfig{
+			BaseURL: "https://api.github.com",
+		},
+		Cache: CacheConfig{
+			TTL:          10 * time.Minute,
+			MaxEntries:   10000,
+			MaxBytes:     64 << 20,
+			Fields:       defaultProjectFields,
+			Compression:  compressNone,
+			Warmup:       warmupFull,
+			WarmupKeys:   defaultWarmupKeys,
+			FreshFor:     defaultFreshFor,
+			NotFoundTTL:  defaultNotFoundTTL,
+			TombstoneTTL: defaultTombstoneTTL,
+		},
+		Channels: ChannelConfig{
+			Updates:        defaultUpdatesChannel,
+			MaxInlineBytes: defaultMaxInlineUpdateBytes,
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the command line arguments, the
+// environment and the YAML file named by -config or CONFIG_FILE, and
+// validates it.
+func LoadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("space-based", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path of an optional YAML config file")
+	var flagCfg Config
+	var replicas, addrs, fields string
+	fs.StringVar(&flagCfg.Redis.Mode, "redis-mode", "", "standalone, sentinel or cluster (REDIS_MODE)")
+	fs.StringVar(&replicas, "redis-replicas", "", "comma separated read replica addresses (REDIS_REPLICAS)")
+	fs.StringVar(&addrs, "redis-addrs", "", "comma separated sentinel or cluster addresses (REDIS_ADDRS)")
+	fs.StringVar(&flagCfg.Redis.MasterName, "redis-master-name", "", "master name known to the sentinels (REDIS_MASTER_NAME)")
+	fs.StringVar(&flagCfg.ListenAddr, "listen", "", "HTTP listen address (LISTEN_ADDR)")
+	fs.DurationVar(&flagCfg.DrainDelay, "drain-delay", 0, "how long to keep serving as unready before shutting down (DRAIN_DELAY)")
+	fs.DurationVar(&flagCfg.ShutdownTimeout, "shutdown-timeout", 0, "deadline for in-flight requests on shutdown (SHUTDOWN_TIMEOUT)")
+	fs.StringVar(&flagCfg.Backend, "backend", "", "central cache: redis, or memory for a single node without Redis (CACHE_BACKEND)")
+	fs.StringVar(&flagCfg.Redis.Addr, "redis-addr", "", "Redis address host:port (REDIS_ADDR)")
+	fs.StringVar(&flagCfg.Redis.Password, "redis-password", "", "Redis password (REDIS_PASSWORD)")
+	fs.IntVar(&flagCfg.Redis.DB, "redis-db", 0, "Redis database number (REDIS_DB)")
+	fs.BoolVar(&flagCfg.Redis.TLS, "redis-tls", false, "connect to Redis over TLS (REDIS_TLS)")
+	fs.StringVar(&flagCfg.GitHub.BaseURL, "github-url", "", "GitHub API base URL (GITHUB_API_URL)")
+	fs.StringVar(&flagCfg.GitHub.Token, "github-token", "", "GitHub API token (GITHUB_TOKEN)")
+	fs.StringVar(&flagCfg.GitHub.WebhookSecret, "github-webhook-secret", "", "secret GitHub signs webhooks with (GITHUB_WEBHOOK_SECRET)")
+	fs.DurationVar(&flagCfg.Cache.TTL, "cache-ttl", 0, "local cache entry TTL (CACHE_TTL)")
+	fs.IntVar(&flagCfg.Cache.MaxEntries, "cache-max-entries", 0, "local cache entry limit (CACHE_MAX_ENTRIES)")
+	fs.Int64Var(&flagCfg.Cache.MaxBytes, "cache-max-bytes", 0, "local cache size limit in bytes (CACHE_MAX_BYTES)")
+	fs.StringVar(&fields, "project-fields", "", "comma separated stored project fields, * for all (PROJECT_FIELDS)")
+	fs.StringVar(&flagCfg.Cache.Compression, "compression", "", "compression of stored values: none, gzip or zstd (CACHE_COMPRESSION)")
+	fs.StringVar(&flagCfg.Cache.Warmup, "cache-warmup", "", "load all projects (full) or only the most requested (hot) on start (CACHE_WARMUP)")
+	fs.IntVar(&flagCfg.Cache.WarmupKeys, "cache-warmup-keys", 0, "projects loaded by a hot warm-up (CACHE_WARMUP_KEYS)")
+	fs.DurationVar(&flagCfg.Cache.FreshFor, "fresh-for", 0, "age after which projects are revalidated (PROJECT_FRESH_FOR)")
+	fs.DurationVar(&flagCfg.Cache.NotFoundTTL, "not-found-ttl", 0, "how long missing repositories are remembered (NOT_FOUND_TTL)")
+	fs.DurationVar(&flagCfg.Cache.TombstoneTTL, "tombstone-ttl", 0, "how long deleted keys are remembered (TOMBSTONE_TTL)")
+	fs.StringVar(&flagCfg.Channels.Updates, "updates-channel", "", "Pub/Sub channel for cache updates (UPDATES_CHANNEL)")
+	fs.IntVar(&flagCfg.Channels.MaxInlineBytes, "updates-max-inline-bytes", 0, "largest value sent with a cache update (UPDATES_MAX_INLINE_BYTES)")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return Config{}, fmt.Errorf("parsing config file %s: %w", *configFile, err)
+		}
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return Config{}, err
+	}
+
+	// Only flags given on the command line override the other sources.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = flagCfg.ListenAddr
+		case "drain-delay":
+			cfg.DrainDelay = flagCfg.DrainDelay
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = flagCfg.ShutdownTimeout
+		case "backend":
+			cfg.Backend = flagCfg.Backend
+		case "redis-mode":
+			cfg.Redis.Mode = flagCfg.Redis.Mode
+		case "redis-replicas":
+			cfg.Redis.Replicas = splitList(replicas)
+		case "redis-addrs":
+			cfg.Redis.Addrs = splitList(addrs)
+		case "redis-master-name":
+			cfg.Redis.MasterName = flagCfg.Redis.MasterName
+		case "redis-addr":
+			cfg.Redis.Addr = flagCfg.Redis.Addr
+		case "redis-password":
+			cfg.Redis.Password = flagCfg.Redis.Password
+		case "redis-db":
+			cfg.Redis.DB = flagCfg.Redis.DB
+		case "redis-tls":
+			cfg.Redis.TLS = flagCfg.Redis.TLS
+		case "github-url":
+			cfg.GitHub.BaseURL = flagCfg.GitHub.BaseURL
+		case "github-token":
+			cfg.GitHub.Token = flagCfg.GitHub.Token
+		case "github-webhook-secret":
+			cfg.GitHub.WebhookSecret = flagCfg.GitHub.WebhookSecret
+		case "cache-ttl":
+			cfg.Cache.TTL = flagCfg.Cache.TTL
+		case "cache-max-entries":
+			cfg.Cache.MaxEntries = flagCfg.Cache.MaxEntries
+		case "cache-max-bytes":
+			cfg.Cache.MaxBytes = flagCfg.Cache.MaxBytes
+		case "project-fields":
+			cfg.Cache.Fields = splitList(fields)
+		case "compression":
+			cfg.Cache.Compression = flagCfg.Cache.Compression
+		case "cache-warmup":
+			cfg.Cache.Warmup = flagCfg.Cache.Warmup
+		case "cache-warmup-keys":
+			cfg.Cache.WarmupKeys = flagCfg.Cache.WarmupKeys
+		case "fresh-for":
+			cfg.Cache.FreshFor = flagCfg.Cache.FreshFor
+		case "not-found-ttl":
+			cfg.Cache.NotFoundTTL = flagCfg.Cache.NotFoundTTL
+		case "tombstone-ttl":
+			cfg.Cache.TombstoneTTL = flagCfg.Cache.TombstoneTTL
+		case "updates-channel":
+			cfg.Channels.Updates = flagCfg.Channels.Updates
+		case "updates-max-inline-bytes":
+			cfg.Channels.MaxInlineBytes = flagCfg.Channels.MaxInlineBytes
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// applyEnv overrides the configuration with the environment variables that are set.
+func applyEnv(cfg *Config) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = splitList(v)
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not an integer", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a duration like 5m", name, v))
+				return
+			}
+			*dst = d
+		}
+	}
+
+	str("LISTEN_ADDR", &cfg.ListenAddr)
+	duration("DRAIN_DELAY", &cfg.DrainDelay)
+	duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	str("CACHE_BACKEND", &cfg.Backend)
+	str("REDIS_MODE", &cfg.Redis.Mode)
+	str("REDIS_ADDR", &cfg.Redis.Addr)
+	list("REDIS_REPLICAS", &cfg.Redis.Replicas)
+	list("REDIS_ADDRS", &cfg.Redis.Addrs)
+	str("REDIS_MASTER_NAME", &cfg.Redis.MasterName)
+	str("REDIS_PASSWORD", &cfg.Redis.Password)
+	integer("REDIS_DB", &cfg.Redis.DB)
+	boolean("REDIS_TLS", &cfg.Redis.TLS)
+	str("GITHUB_API_URL", &cfg.GitHub.BaseURL)
+	str("GITHUB_TOKEN", &cfg.GitHub.Token)
+	str("GITHUB_WEBHOOK_SECRET", &cfg.GitHub.WebhookSecret)
+	duration("CACHE_TTL", &cfg.Cache.TTL)
+	integer("CACHE_MAX_ENTRIES", &cfg.Cache.MaxEntries)
+	if v, ok := os.LookupEnv("CACHE_MAX_BYTES"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("CACHE_MAX_BYTES: %q is not an integer", v))
+		} else {
+			cfg.Cache.MaxBytes = n
+		}
+	}
+	list("PROJECT_FIELDS", &cfg.Cache.Fields)
+	str("CACHE_COMPRESSION", &cfg.Cache.Compression)
+	str("CACHE_WARMUP", &cfg.Cache.Warmup)
+	integer("CACHE_WARMUP_KEYS", &cfg.Cache.WarmupKeys)
+	duration("PROJECT_FRESH_FOR", &cfg.Cache.FreshFor)
+	duration("NOT_FOUND_TTL", &cfg.Cache.NotFoundTTL)
+	duration("TOMBSTONE_TTL", &cfg.Cache.TombstoneTTL)
+	str("UPDATES_CHANNEL", &cfg.Channels.Updates)
+	integer("UPDATES_MAX_INLINE_BYTES", &cfg.Channels.MaxInlineBytes)
+
+	return errors.Join(errs...)
+}
+
+// Validate reports all invalid settings at once.
+func (cfg Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen address %q must be host:port or :port", cfg.ListenAddr))
+	}
+	if cfg.DrainDelay < 0 {
+		errs = append(errs, fmt.Errorf("drain delay %s must not be negative", cfg.DrainDelay))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown timeout %s must be positive", cfg.ShutdownTimeout))
+	}
+	switch cfg.Backend {
+	case backendRedis:
+		errs = append(errs, cfg.Redis.validate()...)
+	case backendMemory:
+	default:
+		errs = append(errs, fmt.Errorf("backend %q must be redis or memory", cfg.Backend))
+	}
+	if u, err := url.Parse(cfg.GitHub.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("github base URL %q must be an http(s) URL", cfg.GitHub.BaseURL))
+	}
+	if cfg.Cache.TTL < 0 {
+		errs = append(errs, fmt.Errorf("cache ttl %s must not be negative", cfg.Cache.TTL))
+	}
+	if cfg.Cache.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("cache max entries %d must not be negative", cfg.Cache.MaxEntries))
+	}
+	if cfg.Cache.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("cache max bytes %d must not be negative", cfg.Cache.MaxBytes))
+	}
+	if len(cfg.Cache.Fields) == 0 {
+		errs = append(errs, errors.New("project fields must not be empty, use * to keep all"))
+	}
+	switch cfg.Cache.Compression {
+	case compressNone, compressGzip, compressZstd:
+	default:
+		errs = append(errs, fmt.Errorf("compression %q must be none, gzip or zstd", cfg.Cache.Compression))
+	}
+	if cfg.Cache.Warmup != warmupFull && cfg.Cache.Warmup != warmupHot {
+		errs = append(errs, fmt.Errorf("cache warm-up %q must be full or hot", cfg.Cache.Warmup))
+	}
+	if cfg.Cache.Warmup == warmupHot && cfg.Cache.WarmupKeys <= 0 {
+		errs = append(errs, fmt.Errorf("cache warm-up keys %d must be positive", cfg.Cache.WarmupKeys))
+	}
+	if cfg.Cache.FreshFor <= 0 {
+		errs = append(errs, fmt.Errorf("fresh-for %s must be positive", cfg.Cache.FreshFor))
+	}
+	if cfg.Cache.NotFoundTTL < time.Second {
+		errs = append(errs, fmt.Errorf("not-found ttl %s must be at least 1s", cfg.Cache.NotFoundTTL))
+	}
+	if cfg.Cache.TombstoneTTL <= 0 {
+		errs = append(errs, fmt.Errorf("tombstone ttl %s must be positive", cfg.Cache.TombstoneTTL))
+	}
+	if cfg.Channels.MaxInlineBytes <= 0 {
+		errs = append(errs, fmt.Errorf("updates max inline bytes %d must be positive", cfg.Channels.MaxInlineBytes))
+	}
+	if cfg.Channels.Updates == "" {
+		errs = append(errs, errors.New("updates channel must not be empty"))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks the settings needed by the configured Redis mode.
+func (cfg RedisConfig) validate() []error {
+	var errs []error
+	checkAddrs := func(what string, addrs []string) {
+		for _, addr := range addrs {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				errs = append(errs, fmt.Errorf("%s address %q must be host:port", what, addr))
+			}
+		}
+	}
+	switch cfg.Mode {
+	case redisStandalone:
+		checkAddrs("redis", []string{cfg.Addr})
+		checkAddrs("redis replica", cfg.Replicas)
+	case redisSentinel:
+		if len(cfg.Addrs) == 0 {
+			errs = append(errs, errors.New("redis sentinel mode needs at least one sentinel address"))
+		}
+		checkAddrs("redis sentinel", cfg.Addrs)
+		if cfg.MasterName == "" {
+			errs = append(errs, errors.New("redis sentinel mode needs a master name"))
+		}
+	case redisCluster:
+		if len(cfg.Addrs) == 0 {
+			errs = append(errs, errors.New("redis cluster mode needs at least one node address"))
+		}
+		checkAddrs("redis cluster node", cfg.Addrs)
+		if cfg.DB != 0 {
+			errs = append(errs, fmt.Errorf("redis db %d cannot be used in cluster mode", cfg.DB))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("redis mode %q must be standalone, sentinel or cluster", cfg.Mode))
+	}
+	if cfg.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis db %d must not be negative", cfg.DB))
+	}
+	return errs
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a YAML config file and returns its path.
+func writeConfigFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Fatalf("config = %+v, want the defaults %+v", cfg, defaultConfig())
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_addr: ":9000"
+redis:
+  addr: "yaml:6379"
+  db: 2
+cache:
+  ttl: 1m
+  fresh_for: 2m
+channels:
+  updates: yaml_updates
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("REDIS_ADDR", "env:6379")
+	t.Setenv("PROJECT_FRESH_FOR", "3m")
+	t.Setenv("UPDATES_CHANNEL", "env_updates")
+	t.Setenv("GITHUB_WEBHOOK_SECRET", "env_secret")
+	t.Setenv("CACHE_BACKEND", "memory")
+
+	cfg, err := LoadConfig([]string{"-fresh-for", "4m", "-drain-delay", "0s"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	for _, c := range []struct {
+		name      string
+		got, want any
+	}{
+		{"listen address from YAML", cfg.ListenAddr, ":9000"},
+		{"redis db from YAML", cfg.Redis.DB, 2},
+		{"cache ttl from YAML", cfg.Cache.TTL, time.Minute},
+		{"redis address from env over YAML", cfg.Redis.Addr, "env:6379"},
+		{"updates channel from env over YAML", cfg.Channels.Updates, "env_updates"},
+		{"webhook secret from env", cfg.GitHub.WebhookSecret, "env_secret"},
+		{"backend from env", cfg.Backend, backendMemory},
+		{"fresh-for from flag over env and YAML", cfg.Cache.FreshFor, 4 * time.Minute},
+		{"not-found ttl default", cfg.Cache.NotFoundTTL, defaultNotFoundTTL},
+		{"drain delay disabled by flag", cfg.DrainDelay, time.Duration(0)},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoadConfigRedisLists(t *testing.T) {
+	t.Setenv("REDIS_REPLICAS", "r1:6379, r2:6379,")
+	t.Setenv("PROJECT_FIELDS", "name,owner.login")
+	cfg, err := LoadConfig([]string{"-redis-mode", "cluster", "-redis-addrs", "n1:7000,n2:7000"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.Redis.Replicas, []string{"r1:6379", "r2:6379"}) {
+		t.Errorf("replicas = %q", cfg.Redis.Replicas)
+	}
+	if cfg.Redis.Mode != redisCluster || !reflect.DeepEqual(cfg.Redis.Addrs, []string{"n1:7000", "n2:7000"}) {
+		t.Errorf("mode = %q, addrs = %q", cfg.Redis.Mode, cfg.Redis.Addrs)
+	}
+	if !reflect.DeepEqual(cfg.Cache.Fields, []string{"name", "owner.login"}) {
+		t.Errorf("project fields = %q", cfg.Cache.Fields)
+	}
+}
+
+func TestLoadConfigFlagsOverrideOnlyWhenGiven(t *testing.T) {
+	t.Setenv("REDIS_DB", "3")
+
+	// -redis-db is not given, so its zero flag value must not reset the env.
+	cfg, err := LoadConfig([]string{"-listen", ":7000"})
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.ListenAddr != ":7000" || cfg.Redis.DB != 3 {
+		t.Fatalf("listen = %q, redis db = %d, want :7000 and 3", cfg.ListenAddr, cfg.Redis.DB)
+	}
+}
+
+func TestLoadConfigReportsBadSources(t *testing.T) {
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("REDIS_DB", "two")
+		t.Setenv("CACHE_TTL", "10")
+		_, err := LoadConfig(nil)
+		if err == nil {
+			t.Fatal("LoadConfig accepted invalid environment variables")
+		}
+		for _, want := range []string{`REDIS_DB: "two" is not an integer`, `CACHE_TTL: "10" is not a duration like 5m`} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q does not contain %q", err, want)
+			}
+		}
+	})
+	t.Run("file", func(t *testing.T) {
+		path := writeConfigFile(t, "redis: [")
+		if _, err := LoadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "parsing config file") {
+			t.Fatalf("err = %v, want a parse error", err)
+		}
+		if _, err := LoadConfig([]string{"-config", path + ".missing"}); err == nil || !strings.Contains(err.Error(), "reading config file") {
+			t.Fatalf("err = %v, want a read error", err)
+		}
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"listen address", func(c *Config) { c.ListenAddr = "8080" }, `listen address "8080" must be host:port or :port`},
+		{"drain delay", func(c *Config) { c.DrainDelay = -time.Second }, "drain delay -1s must not be negative"},
+		{"shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown timeout 0s must be positive"},
+		{"backend", func(c *Config) { c.Backend = "etcd" }, `backend "etcd" must be redis or memory`},
+		{"redis address", func(c *Config) { c.Redis.Addr = "localhost" }, `redis address "localhost" must be host:port`},
+		{"redis db", func(c *Config) { c.Redis.DB = -1 }, "redis db -1 must not be negative"},
+		{"redis mode", func(c *Config) { c.Redis.Mode = "replicated" }, `redis mode "replicated" must be standalone, sentinel or cluster`},
+		{"redis replica", func(c *Config) { c.Redis.Replicas = []string{"replica"} }, `redis replica address "replica" must be host:port`},
+		{"sentinel addresses", func(c *Config) { c.Redis.Mode, c.Redis.MasterName = redisSentinel, "m" }, "redis sentinel mode needs at least one sentinel address"},
+		{"sentinel master", func(c *Config) { c.Redis.Mode, c.Redis.Addrs = redisSentinel, []string{"s:26379"} }, "redis sentinel mode needs a master name"},
+		{"cluster addresses", func(c *Config) { c.Redis.Mode = redisCluster }, "redis cluster mode needs at least one node address"},
+		{"cluster node", func(c *Config) { c.Redis.Mode, c.Redis.Addrs = redisCluster, []string{"node"} }, `redis cluster node address "node" must be host:port`},
+		{"cluster db", func(c *Config) { c.Redis.Mode, c.Redis.Addrs, c.Redis.DB = redisCluster, []string{"n:7000"}, 1 }, "redis db 1 cannot be used in cluster mode"},
+		{"github URL", func(c *Config) { c.GitHub.BaseURL = "api.github.com" }, `github base URL "api.github.com" must be an http(s) URL`},
+		{"cache ttl", func(c *Config) { c.Cache.TTL = -time.Second }, "cache ttl -1s must not be negative"},
+		{"cache max entries", func(c *Config) { c.Cache.MaxEntries = -1 }, "cache max entries -1 must not be negative"},
+		{"cache max bytes", func(c *Config) { c.Cache.MaxBytes = -1 }, "cache max bytes -1 must not be negative"},
+		{"project fields", func(c *Config) { c.Cache.Fields = nil }, "project fields must not be empty, use * to keep all"},
+		{"compression", func(c *Config) { c.Cache.Compression = "lz4" }, `compression "lz4" must be none, gzip or zstd`},
+		{"cache warm-up", func(c *Config) { c.Cache.Warmup = "lazy" }, `cache warm-up "lazy" must be full or hot`},
+		{"cache warm-up keys", func(c *Config) { c.Cache.Warmup, c.Cache.WarmupKeys = warmupHot, 0 }, "cache warm-up keys 0 must be positive"},
+		{"fresh-for", func(c *Config) { c.Cache.FreshFor = 0 }, "fresh-for 0s must be positive"},
+		{"not-found ttl", func(c *Config) { c.Cache.NotFoundTTL = 500 * time.Millisecond }, "not-found ttl 500ms must be at least 1s"},
+		{"tombstone ttl", func(c *Config) { c.Cache.TombstoneTTL = 0 }, "tombstone ttl 0s must be positive"},
+		{"updates max inline bytes", func(c *Config) { c.Channels.MaxInlineBytes = 0 }, "updates max inline bytes 0 must be positive"},
+		{"updates channel", func(c *Config) { c.Channels.Updates = "" }, "updates channel must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("Validate() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("memory backend", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Backend = backendMemory
+		cfg.Redis.Addr = "unused"
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("Validate() = %v, want the Redis settings ignored", err)
+		}
+	})
+
+	t.Run("all at once", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Redis.DB = -1
+		cfg.Channels.Updates = ""
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), "redis db") || !strings.Contains(err.Error(), "updates channel") {
+			t.Fatalf("Validate() = %v, want both errors", err)
+		}
+	})
+}
+
+func TestNewLocalCacheDefaults(t *testing.T) {
+	cache := NewLocalCache(CacheOptions{TombstoneTTL: time.Hour})
+	if cache.opts.WarmupMode != warmupFull || cache.opts.WarmupKeys != defaultWarmupKeys || cache.opts.FreshFor != defaultFreshFor || cache.opts.NotFoundTTL != defaultNotFoundTTL ||
+		cache.opts.TombstoneTTL != time.Hour ||
+		!reflect.DeepEqual(cache.opts.Fields, defaultProjectFields) || cache.opts.Compression != compressNone || cache.opts.MaxInlineUpdateBytes != defaultMaxInlineUpdateBytes {
+		t.Fatalf("options = %+v, want defaults except the tombstone TTL", cache.opts)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for stored project values.
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// defaultProjectFields are the fields of the GitHub repository JSON that
+// TeamUp shows or searches by.
+var defaultProjectFields = []string{
+	"id", "name", "full_name", "description", "html_url", "homepage",
+	"language", "topics", "license.spdx_id", "owner.login", "owner.avatar_url",
+	"stargazers_count", "forks_count", "open_issues_count", "default_branch",
+	"archived", "created_at", "updated_at", "pushed_at",
+}
+
+// compressMinBytes is the size from which encoded projects are compressed.
+const compressMinBytes = 512
+
+// Compressed values are base64 encoded after this prefix, so that they stay
+// valid in JSON messages. JSON itself never starts with either prefix.
+const (
+	gzipPrefix = "gzip:"
+	zstdPrefix = "zstd:"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// projectJSON returns the fields of the JSON object data named by paths, dotted
+// like "owner.login". Fields missing in data are skipped; data that is not an
+// object is kept, and so is all of it for no paths or the single path "*".
+func projectJSON(data json.RawMessage, paths []string) json.RawMessage {
+	if len(paths) == 0 || len(paths) == 1 && paths[0] == "*" {
+		return data
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil || doc == nil {
+		return data
+	}
+
+	fields := make(map[string]json.RawMessage)
+	nested := make(map[string][]string)
+	for _, path := range paths {
+		head, rest, isNested := strings.Cut(path, ".")
+		value, ok := doc[head]
+		if !ok {
+			continue
+		}
+		if isNested {
+			nested[head] = append(nested[head], rest)
+		} else {
+			fields[head] = value
+		}
+	}
+	for head, rest := range nested {
+		if _, whole := fields[head]; !whole {
+			fields[head] = projectJSON(doc[head], rest)
+		}
+	}
+
+	projected, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return projected
+}
+
+// compressValue compresses an encoded project of at least compressMinBytes
+// with the given algorithm. Values are decoded whatever the algorithm was, so
+// pods can switch it one at a time.
+func compressValue(value, algorithm string) string {
+	if len(value) < compressMinBytes {
+		return value
+	}
+	switch algorithm {
+	case compressGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(value))
+		zw.Close()
+		return gzipPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+	case compressZstd:
+		return zstdPrefix + base64.StdEncoding.EncodeToString(zstdEncoder.EncodeAll([]byte(value), nil))
+	default:
+		return value
+	}
+}
+
+// decompressValue returns the JSON of a value written by compressValue.
+func decompressValue(value string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(value, gzipPrefix):
+		compressed, err := base64.StdEncoding.DecodeString(value[len(gzipPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("decoding gzip value: %w", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing gzip value: %w", err)
+		}
+		return io.ReadAll(zr)
+	case strings.HasPrefix(value, zstdPrefix):
+		compressed, err := base64.StdEncoding.DecodeString(value[len(zstdPrefix):])
+		if err != nil {
+			return nil, fmt.Errorf("decoding zstd value: %w", err)
+		}
+		return zstdDecoder.DecodeAll(compressed, nil)
+	default:
+		return []byte(value), nil
+	}
+}
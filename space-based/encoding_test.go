@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProjectJSON(t *testing.T) {
+	data := json.RawMessage(`{"id":1,"name":"repo","owner":{"login":"org","id":2},"license":null,"size":10}`)
+	for _, tt := range []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"name", "owner.login", "license.spdx_id", "missing"}, `{"license":null,"name":"repo","owner":{"login":"org"}}`},
+		{[]string{"owner", "owner.login"}, `{"owner":{"login":"org","id":2}}`},
+		{[]string{"*"}, string(data)},
+		{nil, string(data)},
+	} {
+		if got := projectJSON(data, tt.paths); string(got) != tt.want {
+			t.Errorf("projectJSON(%q) = %s, want %s", tt.paths, got, tt.want)
+		}
+	}
+	if got := projectJSON(json.RawMessage(`[1]`), []string{"id"}); string(got) != `[1]` {
+		t.Errorf("projectJSON of an array = %s, want it kept", got)
+	}
+}
+
+func TestCompressValue(t *testing.T) {
+	small := cachedProject{Data: json.RawMessage(`{"id":1}`)}.encode()
+	large := cachedProject{Data: json.RawMessage(`{"description":"` + strings.Repeat("a", 2*compressMinBytes) + `"}`)}.encode()
+
+	for _, algorithm := range []string{compressNone, compressGzip, compressZstd} {
+		if got := compressValue(small, algorithm); got != small {
+			t.Errorf("%s: a small value was compressed to %q", algorithm, got)
+		}
+		compressed := compressValue(large, algorithm)
+		if algorithm != compressNone && (!strings.HasPrefix(compressed, algorithm+":") || len(compressed) >= len(large)) {
+			t.Errorf("%s: compressed value %.20q... of %d bytes", algorithm, compressed, len(compressed))
+		}
+		raw, err := decompressValue(compressed)
+		if err != nil || string(raw) != large {
+			t.Errorf("%s: decompressValue = %.20q..., %v, want the original value", algorithm, raw, err)
+		}
+	}
+
+	if _, err := decodeProject(gzipPrefix + "not base64"); err == nil {
+		t.Error("decodeProject accepted a broken compressed value")
+	}
+}
+
+func TestStoreProjectKeepsConfiguredFields(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{Fields: []string{"name", "language"}, Compression: compressGzip})
+
+	data := `{"name":"repo","language":"Go","description":"` + strings.Repeat("a", 2*compressMinBytes) + `"}`
+	p := cachedProject{Data: json.RawMessage(data), FetchedAt: time.Now()}
+	if _, err := storeProject(context.Background(), be, cache, "project:org:repo", p, false); err != nil {
+		t.Fatalf("storeProject: %v", err)
+	}
+	stored, err := decodeProject(mr.HGet(projectsKey, "project:org:repo"))
+	if err != nil || string(stored.Data) != `{"language":"Go","name":"repo"}` {
+		t.Fatalf("stored project = %s, %v, want only the configured fields", stored.Data, err)
+	}
+
+	// Large values are compressed.
+	cache = NewLocalCache(CacheOptions{Fields: []string{"*"}, Compression: compressGzip})
+	if _, err := storeProject(context.Background(), be, cache, "project:org:large", p, false); err != nil {
+		t.Fatalf("storeProject: %v", err)
+	}
+	value := mr.HGet(projectsKey, "project:org:large")
+	if !strings.HasPrefix(value, gzipPrefix) {
+		t.Fatalf("large value %.20q... was not compressed", value)
+	}
+	if stored, err := decodeProject(value); err != nil || string(stored.Data) != data {
+		t.Fatalf("decoding the compressed value = %v", err)
+	}
+}
+
+func TestGitHubClientKeepsConfiguredFields(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushedAt := "2026-01-01T00:00:00Z"
+		if r.URL.Path == "/repos/org/pushed" {
+			pushedAt = "2026-02-01T00:00:00Z"
+		}
+		w.Write([]byte(`{"name":"repo","pushed_at":"` + pushedAt + `"}`))
+	}))
+	defer srv.Close()
+	client := NewGitHubClient(srv.URL, "", []string{"name"})
+
+	p, _, err := client.FetchProject(context.Background(), "org", "repo", nil)
+	if err != nil || string(p.Data) != `{"name":"repo"}` {
+		t.Fatalf("FetchProject = %s, %v, want only the name", p.Data, err)
+	}
+
+	// A change of a field that is not kept is not a change.
+	if _, changed, err := client.FetchProject(context.Background(), "org", "pushed", &p); err != nil || changed {
+		t.Fatalf("FetchProject after a change of another field = %v, changed %v", err, changed)
+	}
+}
+
+func TestPublishUpdateLeavesOutLargeValues(t *testing.T) {
+	_, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{MaxInlineUpdateBytes: 64})
+	ctx := context.Background()
+	sub := be.Subscribe(ctx)
+	defer sub.Close()
+	if event, err := sub.Receive(ctx, time.Second); err != nil || !event.Subscribed {
+		t.Fatalf("subscribing: %+v, %v", event, err)
+	}
+
+	receive := func() CacheUpdate {
+		t.Helper()
+		event, err := sub.Receive(ctx, time.Second)
+		if err != nil {
+			t.Fatalf("receiving update: %v", err)
+		}
+		var update CacheUpdate
+		if err := json.Unmarshal([]byte(event.Payload), &update); err != nil {
+			t.Fatalf("decoding update: %v", err)
+		}
+		return update
+	}
+
+	small := cachedProject{Data: json.RawMessage(`{}`), Version: 1}.encode()
+	publishUpdate(ctx, be, cache, CacheUpdate{Action: "set", Key: "k", Value: small, Version: 1, Terms: []string{"lang:go"}})
+	if update := receive(); update.Value != small || update.Terms != nil {
+		t.Fatalf("small update = %+v, want the value without terms", update)
+	}
+
+	large := cachedProject{Data: json.RawMessage(`{"description":"` + strings.Repeat("a", 64) + `"}`), Version: 2}.encode()
+	publishUpdate(ctx, be, cache, CacheUpdate{Action: "set", Key: "k", Value: large, Version: 2, Terms: []string{"lang:go"}})
+	if update := receive(); update.Value != "" || len(update.Terms) != 1 {
+		t.Fatalf("large update = %+v, want the terms without the value", update)
+	}
+}
+
+func TestGetProjectHandlerLoadsOutdatedProjects(t *testing.T) {
+	mr, be := newTestRedis(t)
+	upstream := newFakeUpstream(nil)
+	cache := NewLocalCache(CacheOptions{})
+	handler := getProjectHandler(context.Background(), be, cache, upstream)
+
+	cacheProject(cache, "project:org:repo", cachedProject{Data: json.RawMessage(`{"v":1}`), Version: 1, FetchedAt: time.Now()}.encode(), 0)
+	if !cacheOutdated(cache, "project:org:repo", 2) || cacheOutdated(cache, "project:org:repo", 2) {
+		t.Fatal("cacheOutdated did not order by version")
+	}
+	mr.HSet(projectsKey, "project:org:repo", cachedProject{Data: json.RawMessage(`{"v":2}`), Version: 2, FetchedAt: time.Now()}.encode())
+
+	rec := get(handler, "/project/{org}/{repo}", "/project/org/repo")
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"v":2}` {
+		t.Fatalf("GET = %d %q, want the version from Redis", rec.Code, rec.Body.String())
+	}
+	if calls := upstream.Calls(); calls != 0 {
+		t.Fatalf("upstream got %d requests, want 0", calls)
+	}
+}
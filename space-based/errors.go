@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrProjectNotFound is returned when the repository does not exist upstream.
+var ErrProjectNotFound = errors.New("project not found")
+
+// UpstreamError is returned when the upstream API failed or could not be reached.
+type UpstreamError struct {
+	Message string
+	Timeout bool  // the request timed out rather than failed
+	Err     error // underlying error, may be nil
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// newUpstreamError wraps a transport error, noting whether it was a timeout.
+func newUpstreamError(message string, err error) *UpstreamError {
+	var netErr net.Error
+	timeout := errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+	return &UpstreamError{Message: message, Timeout: timeout, Err: err}
+}
+
+// errorResponse is the JSON body of all error responses.
+type errorResponse struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes an error response with the given status and code.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: code, Message: message})
+}
+
+// writeError maps an error from the cache layers or upstream to a JSON error response.
+// Details of unexpected errors are only logged.
+func writeError(w http.ResponseWriter, err error) {
+	var rateLimit *RateLimitError
+	if errors.As(err, &rateLimit) {
+		secs := int((rateLimit.RetryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	status, resp := errorStatus(err)
+	writeJSONError(w, status, resp.Error, resp.Message)
+}
+
+// errorStatus returns the HTTP status and body describing an error.
+func errorStatus(err error) (int, errorResponse) {
+	var rateLimit *RateLimitError
+	var upstream *UpstreamError
+	switch {
+	case errors.Is(err, ErrProjectNotFound):
+		return http.StatusNotFound, errorResponse{Error: "not_found", Message: "Project not found"}
+	case errors.As(err, &rateLimit):
+		return http.StatusTooManyRequests, errorResponse{Error: "rate_limited", Message: "GitHub API rate limit exceeded"}
+	case errors.As(err, &upstream) && upstream.Timeout:
+		log.Printf("Upstream timeout: %v", err)
+		return http.StatusGatewayTimeout, errorResponse{Error: "upstream_timeout", Message: "GitHub API did not respond in time"}
+	case errors.As(err, &upstream):
+		log.Printf("Upstream error: %v", err)
+		return http.StatusBadGateway, errorResponse{Error: "upstream_unavailable", Message: upstream.Message}
+	default:
+		log.Printf("Internal error: %v", err)
+		return http.StatusInternalServerError, errorResponse{Error: "internal", Message: "Internal server error"}
+	}
+}
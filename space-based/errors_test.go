@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		message    string
+		retryAfter string
+	}{
+		{"not found", ErrProjectNotFound, http.StatusNotFound, "not_found", "Project not found", ""},
+		{"rate limited", &RateLimitError{RetryAfter: 1500 * time.Millisecond}, http.StatusTooManyRequests, "rate_limited", "GitHub API rate limit exceeded", "2"},
+		{"timeout", &UpstreamError{Message: "Error querying GitHub API", Timeout: true}, http.StatusGatewayTimeout, "upstream_timeout", "GitHub API did not respond in time", ""},
+		{"upstream", &UpstreamError{Message: "GitHub API returned status 500"}, http.StatusBadGateway, "upstream_unavailable", "GitHub API returned status 500", ""},
+		{"internal", errors.New("redis: connection refused"), http.StatusInternalServerError, "internal", "Internal server error", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeError(rec, tt.err)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Fatalf("Content-Type = %q", got)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			var body errorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != tt.code || body.Message != tt.message {
+				t.Fatalf("body = %+v, want %s: %s", body, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+func TestNewUpstreamErrorDetectsTimeouts(t *testing.T) {
+	if err := newUpstreamError("failed", errors.New("connection refused")); err.Timeout {
+		t.Fatal("a refused connection is reported as a timeout")
+	}
+	err := newUpstreamError("failed", &timeoutError{})
+	if !err.Timeout || !errors.Is(err, err.Err) {
+		t.Fatalf("newUpstreamError = %+v, want a timeout wrapping the cause", err)
+	}
+	if got := err.Error(); got != "failed: i/o timeout" {
+		t.Fatalf("Error() = %q", got)
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
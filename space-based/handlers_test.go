@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeGitHub serves repositories as the GitHub REST API does and counts the
+// requests for each of them.
+type fakeGitHub struct {
+	mu       sync.Mutex
+	repos    map[string]string // "org/repo" -> JSON document
+	requests map[string]int
+}
+
+func newFakeGitHub(t *testing.T) (*fakeGitHub, *GitHubClient) {
+	gh := &fakeGitHub{repos: make(map[string]string), requests: make(map[string]int)}
+	srv := httptest.NewServer(gh)
+	t.Cleanup(srv.Close)
+	return gh, NewGitHubClient(srv.URL, "", nil)
+}
+
+func (gh *fakeGitHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/repos/")
+	gh.mu.Lock()
+	gh.requests[name]++
+	doc, ok := gh.repos[name]
+	gh.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, doc)
+}
+
+func (gh *fakeGitHub) set(name, doc string) {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	gh.repos[name] = doc
+}
+
+func (gh *fakeGitHub) count(name string) int {
+	gh.mu.Lock()
+	defer gh.mu.Unlock()
+	return gh.requests[name]
+}
+
+// newTestPod returns the routes of a pod with its own local cache, served
+// from be. Pods created with the same backend share the central cache.
+func newTestPod(t *testing.T, be *Backend, upstream Upstream) (http.Handler, *LocalCache) {
+	ctx := context.Background()
+	cache := NewLocalCache(CacheOptions{})
+	r := chi.NewRouter()
+	r.Get("/project/{org}/{repo}", getProjectHandler(ctx, be, cache, upstream))
+	r.Put("/project/{org}/{repo}", annotateHandler(be, cache, upstream, false))
+	r.Patch("/project/{org}/{repo}", annotateHandler(be, cache, upstream, true))
+	r.Delete("/project/{org}/{repo}", deleteProjectHandler(be, cache))
+	r.Get("/projects", queryProjectsHandler(be, cache))
+	r.Post("/projects:batchGet", batchGetHandler(ctx, be, cache, upstream))
+	r.Post("/webhooks/github", webhookHandler(ctx, be, cache, upstream, testWebhookSecret))
+	// Background refreshes and hot key counts must not outlive the test.
+	t.Cleanup(backgroundTasks.Wait)
+	return r, cache
+}
+
+// newTestBackend returns an empty in-memory backend.
+func newTestBackend() *Backend {
+	return &Backend{NewMemoryStore(), NewMemoryBroadcaster()}
+}
+
+// do sends a request to h and returns the recorded response.
+func do(h http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode unmarshals a response body into v.
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rec.Body.String(), err)
+	}
+}
+
+const apiRepo = `{"name":"api","language":"Go","owner":{"login":"acme"},"description":"v1","private_notes":"x"}`
+
+func TestGetProjectServesFromEachLayer(t *testing.T) {
+	gh, github := newFakeGitHub(t)
+	gh.set("acme/api", apiRepo)
+	be := newTestBackend()
+	pod, _ := newTestPod(t, be, github)
+	other, _ := newTestPod(t, be, github)
+
+	rec := do(pod, http.MethodGet, "/project/acme/api", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != sourceOrigin {
+		t.Fatalf("first GET = %d, X-Cache %q, want 200 from origin", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	var project map[string]interface{}
+	decode(t, rec, &project)
+	if project["description"] != "v1" || project["private_notes"] != nil {
+		t.Errorf("project = %v, want the kept fields only", project)
+	}
+	etag := rec.Header().Get("ETag")
+
+	if rec := do(pod, http.MethodGet, "/project/acme/api", "", nil); rec.Header().Get("X-Cache") != sourceLocal {
+		t.Errorf("second GET X-Cache = %q, want %q", rec.Header().Get("X-Cache"), sourceLocal)
+	}
+	if rec := do(other, http.MethodGet, "/project/acme/api", "", nil); rec.Header().Get("X-Cache") != sourceRedis {
+		t.Errorf("GET on another pod X-Cache = %q, want %q", rec.Header().Get("X-Cache"), sourceRedis)
+	}
+	if got := gh.count("acme/api"); got != 1 {
+		t.Errorf("upstream requests = %d, want 1", got)
+	}
+
+	rec = do(pod, http.MethodGet, "/project/acme/api", "", http.Header{"If-None-Match": {etag}})
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("conditional GET = %d with %d bytes, want 304 without body", rec.Code, rec.Body.Len())
+	}
+
+	for _, want := range []string{sourceOrigin, sourceLocal} {
+		rec := do(pod, http.MethodGet, "/project/acme/missing", "", nil)
+		if rec.Code != http.StatusNotFound || rec.Header().Get("X-Cache") != want {
+			t.Errorf("GET of a missing project = %d, X-Cache %q, want 404 from %s", rec.Code, rec.Header().Get("X-Cache"), want)
+		}
+	}
+	if got := gh.count("acme/missing"); got != 1 {
+		t.Errorf("upstream requests for the missing project = %d, want 1", got)
+	}
+}
+
+func TestAnnotationsUpdateTheIndex(t *testing.T) {
+	gh, github := newFakeGitHub(t)
+	gh.set("acme/api", apiRepo)
+	gh.set("acme/web", `{"name":"web","language":"TypeScript","owner":{"login":"acme"}}`)
+	pod, _ := newTestPod(t, newTestBackend(), github)
+
+	query := func(target string) []string {
+		t.Helper()
+		rec := do(pod, http.MethodGet, target, "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", target, rec.Code, rec.Body)
+		}
+		var projects []struct {
+			Name string `json:"name"`
+		}
+		decode(t, rec, &projects)
+		var names []string
+		for _, p := range projects {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	for _, name := range []string{"api", "web"} {
+		if rec := do(pod, http.MethodPut, "/project/acme/"+name, `{"types":["service"]}`, nil); rec.Code != http.StatusOK {
+			t.Fatalf("PUT %s = %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+	if got := query("/projects?type=service&owner=acme"); len(got) != 2 {
+		t.Errorf("services = %v, want api and web", got)
+	}
+	if got := query("/projects?type=service&lang=go"); len(got) != 1 || got[0] != "api" {
+		t.Errorf("Go services = %v, want [api]", got)
+	}
+
+	rec := do(pod, http.MethodPatch, "/project/acme/web", `{"types":null,"tier":1}`, nil)
+	var patched struct {
+		Annotations map[string]interface{} `json:"annotations"`
+	}
+	decode(t, rec, &patched)
+	if rec.Code != http.StatusOK || patched.Annotations["types"] != nil || patched.Annotations["tier"] != 1.0 {
+		t.Errorf("PATCH = %d with annotations %v, want types removed and tier set", rec.Code, patched.Annotations)
+	}
+	if got := query("/projects?type=service"); len(got) != 1 || got[0] != "api" {
+		t.Errorf("services after PATCH = %v, want [api]", got)
+	}
+
+	if rec := do(pod, http.MethodGet, "/projects", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /projects without filters = %d, want 400", rec.Code)
+	}
+
+	// DELETE keeps the annotations and revalidates the project with GitHub.
+	if rec := do(pod, http.MethodDelete, "/project/acme/api", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want 204", rec.Code)
+	}
+	if got := query("/projects?type=service"); len(got) != 1 || got[0] != "api" {
+		t.Errorf("services after DELETE = %v, want [api]", got)
+	}
+	rec = do(pod, http.MethodGet, "/project/acme/api", "", nil)
+	backgroundTasks.Wait()
+	if !strings.Contains(rec.Body.String(), `"service"`) || gh.count("acme/api") != 2 {
+		t.Errorf("GET after DELETE = %s with %d upstream requests, want the annotations and a refresh", rec.Body, gh.count("acme/api"))
+	}
+}
+
+func TestBatchGetResolvesEachProject(t *testing.T) {
+	gh, github := newFakeGitHub(t)
+	gh.set("acme/api", apiRepo)
+	gh.set("acme/web", `{"name":"web"}`)
+	pod, _ := newTestPod(t, newTestBackend(), github)
+	do(pod, http.MethodGet, "/project/acme/api", "", nil)
+
+	body := `{"projects":[{"org":"acme","repo":"api"},{"org":"acme","repo":"web"},{"org":"acme","repo":"missing"},{"org":"acme","repo":"api"}]}`
+	rec := do(pod, http.MethodPost, "/projects:batchGet", body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batchGet = %d: %s", rec.Code, rec.Body)
+	}
+	var resp batchResponse
+	decode(t, rec, &resp)
+	if len(resp.Results) != 3 {
+		t.Errorf("results = %v, want one per distinct project", resp.Results)
+	}
+	for name, want := range map[string]int{"acme/api": 200, "acme/web": 200, "acme/missing": 404} {
+		if got := resp.Results[name].Status; got != want {
+			t.Errorf("status of %s = %d, want %d", name, got, want)
+		}
+	}
+	if err := resp.Results["acme/missing"].Error; err == nil || err.Error != "not_found" {
+		t.Errorf("error of acme/missing = %+v, want not_found", err)
+	}
+	if got := gh.count("acme/api"); got != 1 {
+		t.Errorf("upstream requests for a cached project = %d, want 1", got)
+	}
+
+	if rec := do(pod, http.MethodPost, "/projects:batchGet", `{"projects":[{"org":"acme"}]}`, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("batchGet without repo = %d, want 400", rec.Code)
+	}
+}
+
+func TestWebhookRequiresSignature(t *testing.T) {
+	gh, github := newFakeGitHub(t)
+	gh.set("acme/api", apiRepo)
+	pod, _ := newTestPod(t, newTestBackend(), github)
+	do(pod, http.MethodGet, "/project/acme/api", "", nil)
+	gh.set("acme/api", strings.Replace(apiRepo, "v1", "v2", 1))
+
+	push := `{"repository":{"full_name":"acme/api"}}`
+	rec := do(pod, http.MethodPost, "/webhooks/github", push, http.Header{"X-Github-Event": {"push"}})
+	var errResp errorResponse
+	decode(t, rec, &errResp)
+	if rec.Code != http.StatusUnauthorized || errResp.Error != "bad_signature" {
+		t.Fatalf("unsigned delivery = %d %+v, want 401 bad_signature", rec.Code, errResp)
+	}
+
+	rec = do(pod, http.MethodPost, "/webhooks/github", push, http.Header{
+		"X-Github-Event":      {"push"},
+		"X-Hub-Signature-256": {signWebhookPayload(testWebhookSecret, []byte(push))},
+	})
+	var resp webhookResponse
+	decode(t, rec, &resp)
+	if rec.Code != http.StatusAccepted || len(resp.Refreshed) != 1 || resp.Refreshed[0] != "project:acme:api" {
+		t.Fatalf("signed delivery = %d %+v, want project:acme:api refreshed", rec.Code, resp)
+	}
+
+	// The project was fetched a moment ago, the push refreshes it anyway.
+	backgroundTasks.Wait()
+	rec = do(pod, http.MethodGet, "/project/acme/api", "", nil)
+	if !strings.Contains(rec.Body.String(), `"v2"`) {
+		t.Errorf("project after push = %s, want the new description", rec.Body)
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstream   http.HandlerFunc
+		timeout    time.Duration
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name: "rate limited",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "30")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			wantStatus: http.StatusTooManyRequests,
+			wantCode:   "rate_limited",
+		},
+		{
+			name: "failed",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantStatus: http.StatusBadGateway,
+			wantCode:   "upstream_unavailable",
+		},
+		{
+			name: "timed out",
+			upstream: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			timeout:    10 * time.Millisecond,
+			wantStatus: http.StatusGatewayTimeout,
+			wantCode:   "upstream_timeout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.upstream)
+			defer srv.Close()
+			github := NewGitHubClient(srv.URL, "", nil)
+			if tt.timeout > 0 {
+				github.httpClient.Timeout = tt.timeout
+			}
+			pod, _ := newTestPod(t, newTestBackend(), github)
+
+			rec := do(pod, http.MethodGet, "/project/acme/api", "", nil)
+			var resp errorResponse
+			decode(t, rec, &resp)
+			if rec.Code != tt.wantStatus || resp.Error != tt.wantCode {
+				t.Errorf("GET = %d %q, want %d %q", rec.Code, resp.Error, tt.wantStatus, tt.wantCode)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "30" {
+				t.Errorf("Retry-After = %q, want 30", rec.Header().Get("Retry-After"))
+			}
+
+			body := `{"projects":[{"org":"acme","repo":"api"}]}`
+			var batch batchResponse
+			decode(t, do(pod, http.MethodPost, "/projects:batchGet", body, nil), &batch)
+			if result := batch.Results["acme/api"]; result.Status != tt.wantStatus {
+				t.Errorf("batchGet status = %d, want %d", result.Status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cache layers reported in the X-Cache response header.
+const (
+	sourceLocal  = "local"
+	sourceRedis  = "redis"
+	sourceOrigin = "origin"
+)
+
+// projectCacheControl lets clients and proxies keep project responses but
+// revalidate them on every use: annotations can change at any time, and a
+// matching ETag costs only a 304.
+const projectCacheControl = "public, no-cache"
+
+// projectETag returns a strong ETag for a response body.
+func projectETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// lastModified returns the Last-Modified time of a project: the one reported
+// by GitHub, or when it was fetched.
+func (p cachedProject) lastModified() time.Time {
+	if t, err := http.ParseTime(p.LastModified); err == nil {
+		return t
+	}
+	return p.FetchedAt
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using the
+// weak comparison RFC 9110 prescribes for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeProject writes a project with its validators and the cache layer
+// that served it, or 304 Not Modified if the client's copy is current.
+func writeProject(w http.ResponseWriter, r *http.Request, p cachedProject, source string) {
+	body := p.body()
+	etag := projectETag(body)
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", projectCacheControl)
+	if modified := p.lastModified(); !modified.IsZero() {
+		h.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	h.Set("X-Cache", source)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"abc"`
+	for header, want := range map[string]bool{
+		`"abc"`:          true,
+		`W/"abc"`:        true,
+		`"x", "abc"`:     true,
+		`*`:              true,
+		`"abcd"`:         false,
+		`abc`:            false,
+		``:               false,
+		`"x",W/"y"`:      false,
+		` "x" , W/"abc"`: true,
+	} {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestWriteProject(t *testing.T) {
+	fetchedAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	p := cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: fetchedAt}
+
+	rec := httptest.NewRecorder()
+	writeProject(rec, httptest.NewRequest(http.MethodGet, "/", nil), p, sourceLocal)
+	h := rec.Header()
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"id":1}` || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("writeProject = %d %q", rec.Code, rec.Body.String())
+	}
+	if h.Get("ETag") != projectETag([]byte(`{"id":1}`)) || h.Get("Cache-Control") != projectCacheControl ||
+		h.Get("Last-Modified") != "Sun, 01 Mar 2026 12:00:00 GMT" || h.Get("X-Cache") != sourceLocal {
+		t.Fatalf("headers = %v", h)
+	}
+
+	// GitHub's Last-Modified wins over the fetch time.
+	p.LastModified = "Mon, 02 Feb 2026 10:00:00 GMT"
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("If-None-Match", h.Get("ETag"))
+	rec = httptest.NewRecorder()
+	writeProject(rec, req, p, sourceRedis)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("conditional writeProject = %d %q, want 304", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Last-Modified") != p.LastModified || rec.Header().Get("ETag") == "" {
+		t.Fatalf("304 headers = %v", rec.Header())
+	}
+
+	// Annotations change the body and so the ETag.
+	p.Annotations = json.RawMessage(`{"types":["web"]}`)
+	rec = httptest.NewRecorder()
+	writeProject(rec, req, p, sourceRedis)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == h.Get("ETag") {
+		t.Fatalf("annotated writeProject = %d with ETag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestGetProjectHandlerReportsTheServingLayer(t *testing.T) {
+	mr, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"org/origin": `{"id":3}`})
+	cache := NewLocalCache(CacheOptions{})
+	router := chi.NewRouter()
+	router.Get("/project/{org}/{repo}", getProjectHandler(context.Background(), be, cache, upstream))
+
+	cacheProject(cache, "project:org:local", cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now()}.encode(), 0)
+	mr.HSet(projectsKey, "project:org:redis", cachedProject{Data: json.RawMessage(`{"id":2}`), Version: 1, FetchedAt: time.Now()}.encode())
+
+	request := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	for path, want := range map[string]string{
+		"/project/org/local":  sourceLocal,
+		"/project/org/redis":  sourceRedis,
+		"/project/org/origin": sourceOrigin,
+		"/project/org/none":   sourceOrigin,
+	} {
+		if got := request(path, "").Header().Get("X-Cache"); got != want {
+			t.Errorf("GET %s X-Cache = %q, want %q", path, got, want)
+		}
+	}
+
+	// The second request for a project is served locally, and not at all if
+	// the client has it.
+	rec := request("/project/org/redis", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != sourceLocal {
+		t.Fatalf("second GET = %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if rec := request("/project/org/redis", rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+		t.Fatalf("GET with a matching If-None-Match = %d, want 304", rec.Code)
+	}
+}
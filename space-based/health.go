@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readyPingTimeout bounds the central cache ping of the readiness probe.
+const readyPingTimeout = time.Second
+
+// SyncStatus tracks whether the local cache is in sync with Redis. Pods only
+// report ready once their cache was loaded and they receive cache updates.
+type SyncStatus struct {
+	bootstrapped atomic.Bool
+	subscribed   atomic.Bool
+	draining     atomic.Bool
+	lastSeq      atomic.Uint64
+}
+
+// markBootstrapped records that the local cache was loaded from Redis at seq.
+func (s *SyncStatus) markBootstrapped(seq uint64) {
+	s.observeSeq(seq)
+	s.bootstrapped.Store(true)
+}
+
+// setSubscribed records whether the Pub/Sub subscription is established.
+func (s *SyncStatus) setSubscribed(subscribed bool) {
+	s.subscribed.Store(subscribed)
+}
+
+// startDraining makes the pod report unready so no new traffic is routed to it.
+func (s *SyncStatus) startDraining() {
+	s.draining.Store(true)
+}
+
+// observeSeq records the sequence number of an applied update.
+func (s *SyncStatus) observeSeq(seq uint64) {
+	for {
+		last := s.lastSeq.Load()
+		if seq <= last || s.lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// probeResponse is the body of the health and readiness probes.
+type probeResponse struct {
+	Status string          `json:"status"`
+	Checks map[string]bool `json:"checks,omitempty"`
+}
+
+// debugCacheResponse is the body of /debug/cache.
+type debugCacheResponse struct {
+	CacheStats
+	HitRatio      float64 `json:"hit_ratio"`
+	LastUpdateSeq uint64  `json:"last_update_seq"`
+	IndexComplete bool    `json:"index_complete"`
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// healthzHandler reports that the process is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ok"})
+}
+
+// readyzHandler reports whether the pod should receive traffic: the central
+// cache is reachable, the local cache was bootstrapped, cache updates are
+// received and the pod is not shutting down.
+func readyzHandler(be *Backend, status *SyncStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pingCtx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+		defer cancel()
+
+		checks := map[string]bool{
+			"store":      be.Ping(pingCtx) == nil,
+			"bootstrap":  status.bootstrapped.Load(),
+			"subscribed": status.subscribed.Load(),
+			"serving":    !status.draining.Load(),
+		}
+		for _, ok := range checks {
+			if !ok {
+				writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "not ready", Checks: checks})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, probeResponse{Status: "ready", Checks: checks})
+	}
+}
+
+// debugCacheHandler reports the local cache counters and sync position.
+func debugCacheHandler(cache *LocalCache, status *SyncStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := cache.Stats()
+		resp := debugCacheResponse{
+			CacheStats:    stats,
+			LastUpdateSeq: status.lastSeq.Load(),
+			IndexComplete: cache.Index().Complete(),
+		}
+		if lookups := stats.Hits + stats.Misses; lookups > 0 {
+			resp.HitRatio = float64(stats.Hits) / float64(lookups)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSyncStatusObserveSeqKeepsMaximum(t *testing.T) {
+	var status SyncStatus
+	status.observeSeq(5)
+	status.observeSeq(3)
+	if seq := status.lastSeq.Load(); seq != 5 {
+		t.Fatalf("last seq = %d, want 5", seq)
+	}
+	status.markBootstrapped(8)
+	if seq := status.lastSeq.Load(); seq != 8 || !status.bootstrapped.Load() {
+		t.Fatalf("after bootstrap: last seq = %d, bootstrapped = %v", seq, status.bootstrapped.Load())
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	rec := get(healthzHandler, "/healthz", "/healthz")
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Fatalf("GET /healthz = %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	mr, be := newTestRedis(t)
+	status := &SyncStatus{}
+	handler := readyzHandler(be, status)
+
+	check := func(wantCode int, wantChecks map[string]bool) {
+		t.Helper()
+		rec := get(handler, "/readyz", "/readyz")
+		var resp probeResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+		if rec.Code != wantCode {
+			t.Fatalf("GET /readyz = %d, want %d (%+v)", rec.Code, wantCode, resp)
+		}
+		for name, want := range wantChecks {
+			if resp.Checks[name] != want {
+				t.Fatalf("check %s = %v, want %v", name, resp.Checks[name], want)
+			}
+		}
+	}
+
+	check(http.StatusServiceUnavailable, map[string]bool{"store": true, "bootstrap": false, "subscribed": false})
+
+	status.markBootstrapped(1)
+	status.setSubscribed(true)
+	check(http.StatusOK, map[string]bool{"store": true, "bootstrap": true, "subscribed": true})
+
+	status.setSubscribed(false)
+	check(http.StatusServiceUnavailable, map[string]bool{"subscribed": false})
+
+	status.setSubscribed(true)
+	check(http.StatusOK, map[string]bool{"serving": true})
+
+	// A pod shutting down keeps serving but must no longer get traffic.
+	status.startDraining()
+	check(http.StatusServiceUnavailable, map[string]bool{"store": true, "subscribed": true, "serving": false})
+
+	mr.Close()
+	check(http.StatusServiceUnavailable, map[string]bool{"store": false, "bootstrap": true})
+}
+
+func TestDebugCacheHandler(t *testing.T) {
+	cache := NewLocalCache(CacheOptions{})
+	cache.Set("a", "1")
+	cache.Get("a")
+	cache.Get("a")
+	cache.Get("b")
+	cache.Index().MarkComplete()
+	status := &SyncStatus{}
+	status.observeSeq(42)
+
+	rec := get(debugCacheHandler(cache, status), "/debug/cache", "/debug/cache")
+	var resp debugCacheResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if resp.Hits != 2 || resp.Misses != 1 || resp.Entries != 1 {
+		t.Fatalf("stats = %+v, want 2 hits, 1 miss and 1 entry", resp.CacheStats)
+	}
+	if resp.HitRatio < 0.66 || resp.HitRatio > 0.67 || resp.LastUpdateSeq != 42 || !resp.IndexComplete {
+		t.Fatalf("response = %+v", resp)
+	}
+}
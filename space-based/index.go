@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxQueryResults caps the number of projects returned by GET /projects.
+const maxQueryResults = 100
+
+// projectTermsKey is the Redis hash holding the index terms of every project
+// key, so that the index sets can be updated when a project changes.
+const projectTermsKey = "project_terms"
+
+// indexKeyPrefix prefixes the Redis sets holding the project keys of a term.
+const indexKeyPrefix = "idx:"
+
+// ProjectRecord is the typed view of a cached project used for searching.
+type ProjectRecord struct {
+	Key      string   `json:"key"`
+	Owner    string   `json:"owner"`
+	Name     string   `json:"name"`
+	Language string   `json:"language,omitempty"`
+	Types    []string `json:"types,omitempty"` // assigned by users with the "types" annotation
+}
+
+// record extracts the searchable fields of a project. Owner and name fall
+// back to the parts of the "project:{org}:{repo}" key.
+func (p cachedProject) record(key string) ProjectRecord {
+	rec := ProjectRecord{Key: key}
+	if parts := strings.SplitN(key, ":", 3); len(parts) == 3 {
+		rec.Owner, rec.Name = parts[1], parts[2]
+	}
+
+	var data struct {
+		Name     string `json:"name"`
+		Language string `json:"language"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	}
+	if json.Unmarshal(p.Data, &data) == nil {
+		if data.Name != "" {
+			rec.Name = data.Name
+		}
+		if data.Owner.Login != "" {
+			rec.Owner = data.Owner.Login
+		}
+		rec.Language = data.Language
+	}
+
+	var annotations struct {
+		Types []string `json:"types"`
+	}
+	if len(p.Annotations) > 0 && json.Unmarshal(p.Annotations, &annotations) == nil {
+		rec.Types = annotations.Types
+	}
+	return rec
+}
+
+// terms returns the index terms of the record, e.g. "type:web". Terms are
+// lower case so that searches are case-insensitive.
+func (r ProjectRecord) terms() []string {
+	var terms []string
+	for _, t := range r.Types {
+		if t != "" {
+			terms = append(terms, "type:"+strings.ToLower(t))
+		}
+	}
+	if r.Owner != "" {
+		terms = append(terms, "owner:"+strings.ToLower(r.Owner))
+	}
+	if r.Language != "" {
+		terms = append(terms, "lang:"+strings.ToLower(r.Language))
+	}
+	return terms
+}
+
+// ProjectIndex is a pod-local mirror of the Redis secondary indexes. Unlike
+// the cache entries it is never evicted, so it covers every known project.
+type ProjectIndex struct {
+	mu       sync.RWMutex
+	byTerm   map[string]map[string]bool // term -> project keys
+	terms    map[string][]string        // project key -> terms
+	complete bool                       // loaded from Redis at least once
+}
+
+// NewProjectIndex creates an empty index.
+func NewProjectIndex() *ProjectIndex {
+	return &ProjectIndex{
+		byTerm: make(map[string]map[string]bool),
+		terms:  make(map[string][]string),
+	}
+}
+
+// Update replaces the terms of a project key.
+func (ix *ProjectIndex) Update(key string, terms []string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(key)
+	for _, term := range terms {
+		keys, ok := ix.byTerm[term]
+		if !ok {
+			keys = make(map[string]bool)
+			ix.byTerm[term] = keys
+		}
+		keys[key] = true
+	}
+	if len(terms) > 0 {
+		ix.terms[key] = terms
+	}
+}
+
+// Has reports whether the index holds terms of a project key.
+func (ix *ProjectIndex) Has(key string) bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	_, ok := ix.terms[key]
+	return ok
+}
+
+// Remove drops a project key from the index.
+func (ix *ProjectIndex) Remove(key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(key)
+}
+
+func (ix *ProjectIndex) remove(key string) {
+	for _, term := range ix.terms[key] {
+		delete(ix.byTerm[term], key)
+		if len(ix.byTerm[term]) == 0 {
+			delete(ix.byTerm, term)
+		}
+	}
+	delete(ix.terms, key)
+}
+
+// MarkComplete records that the index was loaded with all projects in Redis.
+func (ix *ProjectIndex) MarkComplete() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.complete = true
+}
+
+// Complete reports whether the index can answer queries on its own.
+func (ix *ProjectIndex) Complete() bool {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.complete
+}
+
+// Query returns the sorted project keys having all the given terms.
+func (ix *ProjectIndex) Query(terms []string) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var keys []string
+	for key := range ix.byTerm[terms[0]] {
+		match := true
+		for _, term := range terms[1:] {
+			if !ix.byTerm[term][key] {
+				match = false
+				break
+			}
+		}
+		if match {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// indexProject updates the local index for a project value that was stored in
+// the local cache. Tombstones and not-found markers remove the key.
+func indexProject(cache *LocalCache, key string, p cachedProject) {
+	if p.Deleted || p.NotFound {
+		cache.Index().Remove(key)
+		return
+	}
+	cache.Index().Update(key, p.record(key).terms())
+}
+
+// queryTerms converts the query parameters of GET /projects to index terms.
+func queryTerms(r *http.Request) []string {
+	var terms []string
+	for param, prefix := range map[string]string{"type": "type:", "owner": "owner:", "lang": "lang:"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			terms = append(terms, prefix+strings.ToLower(value))
+		}
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// queryProjectsHandler implements GET /projects?type=&owner=&lang=. All given
+// filters must match. Keys come from the pod's index, or from the central
+// cache's indexes until the local one is complete; values come from the local
+// cache with a single central cache read for the rest.
+func queryProjectsHandler(be *Backend, cache *LocalCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		terms := queryTerms(r)
+		if len(terms) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "At least one of type, owner or lang is required")
+			return
+		}
+
+		var keys []string
+		if cache.Index().Complete() {
+			keys = cache.Index().Query(terms)
+		} else {
+			var err error
+			if keys, err = be.QueryIndex(r.Context(), terms); err != nil {
+				writeError(w, err)
+				return
+			}
+			sort.Strings(keys)
+		}
+		if len(keys) > maxQueryResults {
+			keys = keys[:maxQueryResults]
+		}
+
+		bodies := make(map[string]json.RawMessage, len(keys))
+		var missing []string
+		for _, key := range keys {
+			value, ok := cache.Get(key)
+			if !ok {
+				missing = append(missing, key)
+				continue
+			}
+			p, err := decodeProject(value)
+			if err == nil && p.Outdated {
+				missing = append(missing, key)
+			} else if err == nil && len(p.Data) > 0 {
+				bodies[key] = p.body()
+			}
+		}
+		if len(missing) > 0 {
+			values, err := be.Projects(r.Context(), missing...)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			for i, value := range values {
+				if value == "" {
+					continue
+				}
+				cacheProject(cache, missing[i], value, 0)
+				if p, err := decodeProject(value); err == nil && len(p.Data) > 0 {
+					bodies[missing[i]] = p.body()
+				}
+			}
+		}
+
+		results := make([]json.RawMessage, 0, len(keys))
+		for _, key := range keys {
+			if body, ok := bodies[key]; ok {
+				results = append(results, body)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
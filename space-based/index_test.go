@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProjectRecordTerms(t *testing.T) {
+	p := cachedProject{
+		Data:        json.RawMessage(`{"name":"Repo","language":"Go","owner":{"login":"Org"}}`),
+		Annotations: json.RawMessage(`{"types":["Web","","cli"]}`),
+	}
+	rec := p.record("project:org:repo")
+	want := ProjectRecord{Key: "project:org:repo", Owner: "Org", Name: "Repo", Language: "Go", Types: []string{"Web", "", "cli"}}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("record = %+v, want %+v", rec, want)
+	}
+	if terms := rec.terms(); !reflect.DeepEqual(terms, []string{"type:web", "type:cli", "owner:org", "lang:go"}) {
+		t.Fatalf("terms = %v", terms)
+	}
+
+	// Without upstream data owner and name come from the key.
+	rec = cachedProject{}.record("project:owner:name")
+	if rec.Owner != "owner" || rec.Name != "name" || rec.Language != "" {
+		t.Fatalf("record of the key = %+v", rec)
+	}
+}
+
+func TestProjectIndex(t *testing.T) {
+	ix := NewProjectIndex()
+	ix.Update("a", []string{"owner:org", "lang:go"})
+	ix.Update("b", []string{"owner:org", "lang:rust"})
+	ix.Update("c", []string{"owner:other", "lang:go"})
+
+	if got := ix.Query([]string{"owner:org"}); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("Query(owner:org) = %v", got)
+	}
+	if got := ix.Query([]string{"lang:go", "owner:org"}); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("Query(lang:go, owner:org) = %v", got)
+	}
+
+	ix.Update("a", []string{"owner:org", "lang:rust"})
+	if got := ix.Query([]string{"lang:go"}); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Fatalf("Query(lang:go) after update = %v", got)
+	}
+	ix.Remove("b")
+	if got := ix.Query([]string{"lang:rust"}); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("Query(lang:rust) after remove = %v", got)
+	}
+	if _, ok := ix.byTerm["lang:unknown"]; ok || ix.Query([]string{"lang:unknown"}) != nil {
+		t.Fatal("query of an unknown term created or found keys")
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/projects?type=Web&owner=Org&lang=Go&other=x", nil)
+	if got := queryTerms(r); !reflect.DeepEqual(got, []string{"lang:go", "owner:org", "type:web"}) {
+		t.Fatalf("queryTerms = %v", got)
+	}
+}
+
+func TestStoreVersionedMaintainsRedisIndex(t *testing.T) {
+	mr, be := newTestRedis(t)
+	ctx := context.Background()
+
+	be.StoreVersioned(ctx, "k", "v1", 1, 0, []string{"owner:org", "lang:go"})
+	be.StoreVersioned(ctx, "k", "v2", 2, 0, []string{"owner:org", "lang:rust"})
+	if ok, _ := mr.SIsMember(standaloneKeys.indexSet("lang:go"), "k"); ok {
+		t.Fatal("old term was kept")
+	}
+	if ok, _ := mr.SIsMember(standaloneKeys.indexSet("lang:rust"), "k"); !ok {
+		t.Fatal("new term was not added")
+	}
+
+	be.StoreVersioned(ctx, "k", "", 3, 0, nil)
+	if mr.Exists(standaloneKeys.indexSet("owner:org")) || mr.HGet(projectTermsKey, "k") != "" {
+		t.Fatal("deleted project is still indexed")
+	}
+}
+
+func TestQueryProjectsHandler(t *testing.T) {
+	_, be := newTestRedis(t)
+	ctx := context.Background()
+	writer := NewLocalCache(CacheOptions{})
+	for key, data := range map[string]string{
+		"project:org:a": `{"name":"a","language":"Go","owner":{"login":"org"}}`,
+		"project:org:b": `{"name":"b","language":"Rust","owner":{"login":"org"}}`,
+		"project:x:c":   `{"name":"c","language":"Go","owner":{"login":"x"}}`,
+	} {
+		p := cachedProject{Data: json.RawMessage(data), FetchedAt: time.Now()}
+		if _, err := storeProject(ctx, be, writer, key, p, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A pod that has not bootstrapped yet queries the Redis indexes, a
+	// bootstrapped one its own index.
+	fresh := NewLocalCache(CacheOptions{})
+	bootstrapped := NewLocalCache(CacheOptions{})
+	if _, err := bootstrapCache(ctx, be, bootstrapped); err != nil {
+		t.Fatalf("bootstrapCache: %v", err)
+	}
+	for name, cache := range map[string]*LocalCache{"redis": fresh, "local": bootstrapped} {
+		handler := queryProjectsHandler(be, cache)
+		rec := get(handler, "/projects", "/projects?lang=go")
+		var results []map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(results) != 2 || results[0]["name"] != "a" || results[1]["name"] != "c" {
+			t.Fatalf("%s: GET /projects?lang=go = %v", name, results)
+		}
+		if rec := get(handler, "/projects", "/projects?lang=go&owner=x"); rec.Body.String() != `[{"language":"Go","name":"c","owner":{"login":"x"}}]`+"\n" {
+			t.Fatalf("%s: GET /projects?lang=go&owner=x = %s", name, rec.Body.String())
+		}
+	}
+
+	if rec := get(queryProjectsHandler(be, fresh), "/projects", "/projects"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("GET /projects without filters = %d, want 400", rec.Code)
+	}
+}
+
+func TestResyncCacheDropsDeletedKeysFromIndex(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+	cache.Index().Update("project:org:gone", []string{"owner:org"})
+	mr.HSet(versionsKey, "project:org:gone", "3")
+
+	if _, err := resyncCache(context.Background(), be, cache); err != nil {
+		t.Fatalf("resyncCache: %v", err)
+	}
+
+	if keys := cache.Index().Query([]string{"owner:org"}); len(keys) != 0 {
+		t.Fatalf("index still holds %v", keys)
+	}
+}
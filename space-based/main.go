@@ -3,88 +3,172 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-redis/redis/v8"
 )
 
-var ctx = context.Background()
-
-// LocalCache is a simple thread-safe in-memory cache.
-type LocalCache struct {
-	data sync.Map
-}
-
-// Get returns the value for a given key.
-func (c *LocalCache) Get(key string) (string, bool) {
-	val, ok := c.data.Load(key)
-	if ok {
-		return val.(string), true
-	}
-	return "", false
-}
-
-// Set stores the key/value pair in the cache.
-func (c *LocalCache) Set(key, value string) {
-	c.data.Store(key, value)
-}
-
-// Delete removes a key from the cache.
-func (c *LocalCache) Delete(key string) {
-	c.data.Delete(key)
-}
+// backgroundTasks tracks work started outside of request handlers, such as
+// stale-while-revalidate refreshes, so shutdown can wait for it.
+var backgroundTasks sync.WaitGroup
 
 // CacheUpdate is the structure for Pub/Sub messages to synchronize caches.
 type CacheUpdate struct {
 	Action string `json:"action"`          // "set" or "delete"
 	Key    string `json:"key"`             // e.g. "project:org:repo"
-	Value  string `json:"value,omitempty"` // Only applicable for "set" action
+	Value  string `json:"value,omitempty"` // For "set", left out for large values that are loaded from Redis
+	TTL    int    `json:"ttl,omitempty"`   // Seconds to keep the value, 0 uses the cache default
+
+	// Version orders updates of a key; older updates than the cached value are ignored.
+	Version uint64 `json:"version,omitempty"`
+	// Seq numbers all published updates so subscribers can detect lost messages.
+	Seq uint64 `json:"seq,omitempty"`
+	// Terms are the index terms of a "set" sent without its value.
+	Terms []string `json:"terms,omitempty"`
 }
 
-// bootstrapCache loads existing project data from Redis into the local cache.
-func bootstrapCache(rdb *redis.Client, cache *LocalCache) {
-	projects, err := rdb.HGetAll(ctx, "projects").Result()
-	if err != nil {
-		log.Printf("Error bootstrapping local cache: %v", err)
-		return
+// warmupRetryDelay is the first delay before retrying a failed warm-up. It
+// doubles with each failure up to maxWarmupRetryDelay.
+const (
+	warmupRetryDelay    = time.Second
+	maxWarmupRetryDelay = 30 * time.Second
+)
+
+// subscribeForUpdates listens on the updates channel to keep the local cache in sync.
+// Once subscribed it warms up the local cache, so no update is missed while
+// loading. sinceSeq is the update sequence number the local cache is in sync with,
+// if it was loaded already. Whenever
+// the subscription is (re)established after updates were published, or a gap in
+// the sequence numbers shows that messages were lost, the cache is resynced.
+// The progress is recorded in status for the readiness probe. It returns once
+// ctx is cancelled.
+func subscribeForUpdates(ctx context.Context, be *Backend, cache *LocalCache, sinceSeq uint64, status *SyncStatus) {
+	sub := be.Subscribe(ctx)
+	defer sub.Close()
+	// Closing the subscription interrupts a pending receive.
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+
+	var tracker seqTracker
+	tracker.reset(sinceSeq)
+
+	// warmUp bootstraps the local cache, retrying with backoff until it
+	// succeeds or ctx is cancelled.
+	warmUp := func() {
+		for delay := warmupRetryDelay; ; delay = min(2*delay, maxWarmupRetryDelay) {
+			seq, err := bootstrapCache(ctx, be, cache)
+			if err == nil {
+				tracker.reset(seq)
+				status.markBootstrapped(seq)
+				return
+			}
+			log.Printf("Error warming up local cache, retrying in %v: %v", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+		}
 	}
-	for key, value := range projects {
-		cache.Set(key, value)
-		log.Printf("Bootstrapped cache key: %s", key)
+	resync := func() {
+		// Updates published during the resync are newer than the returned
+		// sequence number and are applied afterwards.
+		seq, err := resyncCache(ctx, be, cache)
+		if err != nil {
+			log.Printf("Error resyncing local cache: %v", err)
+			return
+		}
+		tracker.reset(seq)
+		status.markBootstrapped(seq)
 	}
-}
-
-// subscribeForUpdates listens on the "cache_updates" channel to keep the local cache in sync.
-func subscribeForUpdates(rdb *redis.Client, cache *LocalCache) {
-	pubsub := rdb.Subscribe(ctx, "cache_updates")
-	defer pubsub.Close()
 
 	for {
-		msg, err := pubsub.ReceiveMessage(ctx)
+		event, err := sub.Receive(ctx, gapGrace)
+		if ctx.Err() != nil {
+			status.setSubscribed(false)
+			return
+		}
+		if tracker.expired() {
+			log.Println("Cache updates were lost, resyncing.")
+			resync()
+		}
+		if err == errReceiveTimeout {
+			continue
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Printf("Pub/Sub error: %v", err)
-			time.Sleep(time.Second)
+			status.setSubscribed(false)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if event.Subscribed {
+			// Sent on the first subscribe and after every reconnect.
+			if !status.bootstrapped.Load() {
+				warmUp()
+				status.setSubscribed(true)
+				continue
+			}
+			seq, err := be.UpdateSeq(ctx)
+			if err != nil {
+				log.Printf("Error reading update sequence: %v", err)
+				continue
+			}
+			if seq >= tracker.next {
+				log.Printf("Missed updates up to %d while unsubscribed, resyncing.", seq)
+				resync()
+			}
+			status.setSubscribed(true)
 			continue
 		}
 
 		var update CacheUpdate
-		if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+		if err := json.Unmarshal([]byte(event.Payload), &update); err != nil {
 			log.Printf("Error parsing update message: %v", err)
 			continue
 		}
+		if tracker.observe(update.Seq) {
+			log.Printf("Gap before update %d, resyncing.", update.Seq)
+			resync()
+		}
+		status.observeSeq(update.Seq)
 
 		switch update.Action {
 		case "set":
-			cache.Set(update.Key, update.Value)
+			if update.Value == "" {
+				// Large values are not sent, the next request loads it.
+				if !cacheOutdated(cache, update.Key, update.Version) {
+					log.Printf("Ignored stale update (set): %s version %d", update.Key, update.Version)
+					continue
+				}
+				cache.Index().Update(update.Key, update.Terms)
+				log.Printf("Cache invalidated (set): %s", update.Key)
+				continue
+			}
+			ttl := time.Duration(update.TTL) * time.Second
+			if !cacheProject(cache, update.Key, update.Value, ttl) {
+				log.Printf("Ignored stale update (set): %s version %d", update.Key, update.Version)
+				continue
+			}
 			log.Printf("Cache updated (set): %s", update.Key)
 		case "delete":
-			cache.Delete(update.Key)
+			if !cacheTombstone(cache, update.Key, update.Version) {
+				log.Printf("Ignored stale update (delete): %s version %d", update.Key, update.Version)
+				continue
+			}
 			log.Printf("Cache updated (delete): %s", update.Key)
 		default:
 			log.Printf("Unknown cache update action: %s", update.Action)
@@ -92,119 +176,241 @@ func subscribeForUpdates(rdb *redis.Client, cache *LocalCache) {
 	}
 }
 
+// projectFetches and projectRefreshes coalesce concurrent upstream requests
+// for the same key across all handlers.
+var (
+	projectFetches   flightGroup[cachedProject]
+	projectRefreshes flightGroup[struct{}]
+)
+
+// scheduleRefresh revalidates a stale project in the background, in ctx. force
+// revalidates it with upstream even if another pod just did, see refreshProject.
+func scheduleRefresh(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, key string, p cachedProject, force bool) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		projectRefreshes.Do(key, func() (struct{}, error) {
+			refreshProject(ctx, be, cache, upstream, org, repo, key, p, force)
+			return struct{}{}, nil
+		})
+	}()
+}
+
 // getProjectHandler implements the GET /project/{org}/{repo} endpoint.
 // It uses a read‑through cache strategy:
 //  1. Check local in-memory cache.
-//  2. On miss, check Redis.
-//  3. On cache miss in Redis, query the GitHub API, then save to both caches and publish an update.
-func getProjectHandler(rdb *redis.Client, cache *LocalCache) http.HandlerFunc {
+//  2. On miss, check the central cache (Redis).
+//  3. On cache miss there too, query the GitHub API, then save to both caches and publish an update.
+//
+// Concurrent misses for the same key share a single GitHub request. Stale
+// entries are served immediately and revalidated in the background. Both run
+// in ctx, the server's context, rather than in the context of the request that
+// started them. Responses carry an ETag, honor If-None-Match and name the
+// serving layer in X-Cache.
+func getProjectHandler(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream) http.HandlerFunc {
+	// serve writes a cached value and schedules a refresh if it is stale.
+	serve := func(w http.ResponseWriter, r *http.Request, org, repo, key, value, source string) bool {
+		p, err := decodeProject(value)
+		if err != nil {
+			log.Printf("Error decoding cached %s: %v", key, err)
+			return false
+		}
+		if p.Deleted || p.Outdated {
+			return false
+		}
+		if p.NotFound {
+			w.Header().Set("X-Cache", source)
+			writeError(w, ErrProjectNotFound)
+			return true
+		}
+		if p.stale(cache.opts.FreshFor) {
+			scheduleRefresh(ctx, be, cache, upstream, org, repo, key, p, false)
+		}
+		writeProject(w, r, p, source)
+		return true
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		org := chi.URLParam(r, "org")
 		repo := chi.URLParam(r, "repo")
 		if org == "" || repo == "" {
-			http.Error(w, "Missing organization or repository", http.StatusBadRequest)
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Missing organization or repository")
 			return
 		}
 
 		// Create a key in the form "project:{org}:{repo}"
-		key := fmt.Sprintf("project:%s:%s", org, repo)
+		key := projectKey(org, repo)
 
 		// 1. Check local in-memory cache.
-		if value, ok := cache.Get(key); ok {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(value))
+		if value, ok := cache.Get(key); ok && serve(w, r, org, repo, key, value, sourceLocal) {
 			return
 		}
 
-		// 2. Check Redis (central cache).
-		result, err := rdb.HGet(ctx, "projects", key).Result()
-		if err == nil && result != "" {
+		// 2. Check the central cache.
+		results, err := be.Projects(r.Context(), key)
+		if err == nil && results[0] != "" {
 			// Update local cache before returning.
-			cache.Set(key, result)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(result))
-			return
-		} else if err != nil && err != redis.Nil {
-			log.Printf("Redis error: %v", err)
-		}
-
-		// 3. Cache miss: Query the GitHub API.
-		githubURL := fmt.Sprintf("https://api.github.com/repos/%s/%s", org, repo)
-		client := &http.Client{
-			Timeout: 10 * time.Second,
-		}
-		resp, err := client.Get(githubURL)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			http.Error(w, "Error querying GitHub API", http.StatusInternalServerError)
+			cacheProject(cache, key, results[0], 0)
+			if serve(w, r, org, repo, key, results[0], sourceRedis) {
+				// Count the load, hot projects are loaded when pods warm up.
+				recordHotKeys(ctx, be, cache, key)
+				return
+			}
+		} else if err != nil {
+			log.Printf("Central cache error: %v", err)
+		} else if value, ok := getMissing(r.Context(), be, cache, key); ok && serve(w, r, org, repo, key, value, sourceRedis) {
+			// Known to be missing upstream.
 			return
 		}
-		defer resp.Body.Close()
 
-		body, err := ioutil.ReadAll(resp.Body)
+		// 3. Cache miss: Query the GitHub API, once per key at a time.
+		p, err, shared := projectFetches.Do(key, func() (cachedProject, error) {
+			return fetchProject(ctx, be, cache, upstream, org, repo, key)
+		})
+		w.Header().Set("X-Cache", sourceOrigin)
 		if err != nil {
-			http.Error(w, "Error reading GitHub response", http.StatusInternalServerError)
-			return
-		}
-
-		// Validate that body contains proper JSON.
-		var js json.RawMessage
-		if err := json.Unmarshal(body, &js); err != nil {
-			http.Error(w, "Invalid JSON from GitHub", http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
-
-		// Save the project data in Redis (central cache) in the "projects" hash.
-		if err := rdb.HSet(ctx, "projects", key, body).Err(); err != nil {
-			log.Printf("Error saving project to Redis: %v", err)
+		if shared {
+			log.Printf("Coalesced fetch for %s", key)
 		}
-		// Update local cache.
-		cache.Set(key, string(body))
+		recordHotKeys(ctx, be, cache, key)
 
-		// Publish an update event so that other pods can update their local caches.
-		update := CacheUpdate{
-			Action: "set",
-			Key:    key,
-			Value:  string(body),
-		}
-		payload, err := json.Marshal(update)
-		if err == nil {
-			if err := rdb.Publish(ctx, "cache_updates", string(payload)).Err(); err != nil {
-				log.Printf("Error publishing cache update: %v", err)
-			}
-		} else {
-			log.Printf("Error marshalling cache update: %v", err)
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(body)
+		writeProject(w, r, p, sourceOrigin)
 	}
 }
 
 func main() {
-	// Initialize the Redis client (adjust the address if necessary).
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-		DB:   0, // Use default DB.
-	})
-	defer rdb.Close()
+	cfg, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Initialize the central cache, Redis unless running as a single node.
+	be := newBackend(cfg)
+	log.Printf("Using the %s backend.", cfg.Backend)
 
-	// Initialize the local cache.
-	localCache := &LocalCache{}
+	// ctx scopes the work that outlives a request, such as coalesced fetches,
+	// background refreshes and the Pub/Sub subscriber. It is cancelled once the
+	// server has shut down.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	// 1. Bootstrap the local cache from Redis.
-	bootstrapCache(rdb, localCache)
-	log.Println("Local cache bootstrapped from Redis.")
+	// Initialize the local cache. It is bounded so a pod's memory does not
+	// grow forever; unused entries expire and are reloaded from Redis.
+	localCache := NewLocalCache(CacheOptions{
+		TTL:        cfg.Cache.TTL,
+		MaxEntries: cfg.Cache.MaxEntries,
+		MaxBytes:   cfg.Cache.MaxBytes,
 
-	// 2. Start a background goroutine to subscribe for cache updates.
-	go subscribeForUpdates(rdb, localCache)
+		Fields:               cfg.Cache.Fields,
+		Compression:          cfg.Cache.Compression,
+		MaxInlineUpdateBytes: cfg.Channels.MaxInlineBytes,
+
+		WarmupMode:   cfg.Cache.Warmup,
+		WarmupKeys:   cfg.Cache.WarmupKeys,
+		FreshFor:     cfg.Cache.FreshFor,
+		NotFoundTTL:  cfg.Cache.NotFoundTTL,
+		TombstoneTTL: cfg.Cache.TombstoneTTL,
+	})
+
+	// 1. Start a background goroutine to subscribe for cache updates. It
+	// warms up the local cache first; the pod is ready once that is done.
+	status := &SyncStatus{}
+	subscriberDone := make(chan struct{})
+	go func() {
+		defer close(subscriberDone)
+		subscribeForUpdates(ctx, be, localCache, 0, status)
+	}()
+
+	// 2. Set up the GitHub client, authenticated if a token is configured.
+	github := NewGitHubClient(cfg.GitHub.BaseURL, cfg.GitHub.Token, cfg.Cache.Fields)
 
 	// 3. Set up the HTTP router.
 	r := chi.NewRouter()
-	r.Get("/project/{org}/{repo}", getProjectHandler(rdb, localCache))
+	r.Get("/healthz", healthzHandler)
+	r.Get("/readyz", readyzHandler(be, status))
+	r.Get("/debug/cache", debugCacheHandler(localCache, status))
+	r.Get("/project/{org}/{repo}", getProjectHandler(ctx, be, localCache, github))
+	r.Put("/project/{org}/{repo}", annotateHandler(be, localCache, github, false))
+	r.Patch("/project/{org}/{repo}", annotateHandler(be, localCache, github, true))
+	r.Delete("/project/{org}/{repo}", deleteProjectHandler(be, localCache))
+	r.Get("/projects", queryProjectsHandler(be, localCache))
+	r.Post("/projects:batchGet", batchGetHandler(ctx, be, localCache, github))
+	if cfg.GitHub.WebhookSecret != "" {
+		r.Post("/webhooks/github", webhookHandler(ctx, be, localCache, github, []byte(cfg.GitHub.WebhookSecret)))
+	} else {
+		log.Println("GitHub webhooks disabled, no secret configured.")
+	}
 
 	// Start the web server.
-	log.Println("Server listening on :8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server listening on %s", cfg.ListenAddr)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	// Run until Kubernetes (or the user) asks us to stop.
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Server failed: %v", err)
+	case <-sigCtx.Done():
+	}
+
+	// Report unready but keep serving until the readiness probe has failed
+	// often enough for Kubernetes to stop routing new requests to this pod.
+	status.startDraining()
+	log.Printf("Shutting down, serving for another %s while draining.", cfg.DrainDelay)
+	select {
+	case <-time.After(cfg.DrainDelay):
+	case err := <-serverErr:
+		log.Printf("Server failed while draining: %v", err)
+	}
+
+	log.Printf("Waiting up to %s for in-flight requests.", cfg.ShutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// Stop accepting connections and wait for in-flight requests.
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error draining requests: %v", err)
+	}
+	// Let background refreshes finish, they hold fetch locks in the central cache.
+	if !waitFor(shutdownCtx, backgroundTasks.Wait) {
+		log.Println("Gave up waiting for background refreshes.")
+	}
+	// Abort what is left and stop following updates, the local cache is no
+	// longer needed.
+	cancel()
+	select {
+	case <-subscriberDone:
+	case <-shutdownCtx.Done():
+		log.Println("Gave up waiting for the Pub/Sub subscriber.")
+	}
+	if err := be.Close(); err != nil {
+		log.Printf("Error closing central cache: %v", err)
+	}
+	log.Println("Server stopped.")
+}
+
+// waitFor runs wait and reports whether it returned before ctx was done.
+func waitFor(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestRedis starts an in-memory Redis server and returns a backend using it.
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *Backend) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	be := newRedisBackend(newRedisClient(RedisConfig{Mode: redisStandalone, Addr: mr.Addr()}), defaultUpdatesChannel)
+	t.Cleanup(func() { be.Close() })
+	return mr, be
+}
+
+// fakeUpstream serves projects from memory and counts the requests it gets.
+type fakeUpstream struct {
+	mu       sync.Mutex
+	projects map[string]string // project JSON by "org/repo"
+	calls    int
+	gate     chan struct{} // if not nil, requests wait until it is closed
+}
+
+func newFakeUpstream(projects map[string]string) *fakeUpstream {
+	return &fakeUpstream{projects: projects}
+}
+
+// FetchProject implements Upstream.
+func (u *fakeUpstream) FetchProject(ctx context.Context, org, repo string, prev *cachedProject) (cachedProject, bool, error) {
+	u.mu.Lock()
+	u.calls++
+	data, ok := u.projects[org+"/"+repo]
+	gate := u.gate
+	u.mu.Unlock()
+
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return cachedProject{}, false, ctx.Err()
+		}
+	}
+	if !ok {
+		return cachedProject{}, false, ErrProjectNotFound
+	}
+	p := cachedProject{Data: json.RawMessage(data), FetchedAt: time.Now()}
+	return p, prev == nil || !bytes.Equal(prev.Data, p.Data), nil
+}
+
+// Calls returns the number of requests received so far.
+func (u *fakeUpstream) Calls() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls
+}
+
+// serve sends a request for path to handler mounted at pattern.
+func serve(handler http.HandlerFunc, method, pattern, path, body string) *httptest.ResponseRecorder {
+	r := chi.NewRouter()
+	r.Method(method, pattern, handler)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rec
+}
+
+// get sends a GET request for path to handler mounted at pattern.
+func get(handler http.HandlerFunc, pattern, path string) *httptest.ResponseRecorder {
+	return serve(handler, http.MethodGet, pattern, path, "")
+}
+
+// TestGetProjectHandlerCoalescesMisses checks that concurrent misses on two
+// pods make exactly one upstream request.
+func TestGetProjectHandlerCoalescesMisses(t *testing.T) {
+	_, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"org/repo": `{"id":1}`})
+	upstream.gate = make(chan struct{})
+
+	pods := []http.HandlerFunc{
+		getProjectHandler(context.Background(), be, NewLocalCache(CacheOptions{}), upstream),
+		getProjectHandler(context.Background(), be, NewLocalCache(CacheOptions{}), upstream),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(handler http.HandlerFunc) {
+			defer wg.Done()
+			rec := get(handler, "/project/{org}/{repo}", "/project/org/repo")
+			if rec.Code != http.StatusOK || rec.Body.String() != `{"id":1}` {
+				t.Errorf("GET = %d %q", rec.Code, rec.Body.String())
+			}
+		}(pods[i%len(pods)])
+	}
+
+	for upstream.Calls() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(upstream.gate)
+	wg.Wait()
+
+	if calls := upstream.Calls(); calls != 1 {
+		t.Fatalf("upstream got %d requests, want 1", calls)
+	}
+}
+
+func TestGetProjectHandlerServesCachedProjects(t *testing.T) {
+	mr, be := newTestRedis(t)
+	upstream := newFakeUpstream(nil)
+	cache := NewLocalCache(CacheOptions{})
+	handler := getProjectHandler(context.Background(), be, cache, upstream)
+
+	fresh := cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now()}
+	mr.HSet("projects", "project:org:repo", fresh.encode())
+
+	rec := get(handler, "/project/{org}/{repo}", "/project/org/repo")
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"id":1}` {
+		t.Fatalf("GET = %d %q", rec.Code, rec.Body.String())
+	}
+	if _, ok := cache.Get("project:org:repo"); !ok {
+		t.Fatal("project from Redis was not cached locally")
+	}
+	if calls := upstream.Calls(); calls != 0 {
+		t.Fatalf("upstream got %d requests, want 0", calls)
+	}
+
+}
+
+func TestGetProjectHandlerRemembersMissingProjects(t *testing.T) {
+	_, be := newTestRedis(t)
+	upstream := newFakeUpstream(nil)
+	handler := getProjectHandler(context.Background(), be, NewLocalCache(CacheOptions{}), upstream)
+
+	for i := 0; i < 2; i++ {
+		rec := get(handler, "/project/{org}/{repo}", "/project/org/missing")
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("GET unknown project = %d, want 404", rec.Code)
+		}
+		var body errorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error != "not_found" {
+			t.Fatalf("error body = %+v, %v", body, err)
+		}
+	}
+	if calls := upstream.Calls(); calls != 1 {
+		t.Fatalf("upstream got %d requests, want 1", calls)
+	}
+
+	// Other pods find the not-found marker in Redis.
+	other := getProjectHandler(context.Background(), be, NewLocalCache(CacheOptions{}), upstream)
+	if rec := get(other, "/project/{org}/{repo}", "/project/org/missing"); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET unknown project on another pod = %d, want 404", rec.Code)
+	}
+	if calls := upstream.Calls(); calls != 1 {
+		t.Fatalf("upstream got %d requests, want 1", calls)
+	}
+}
+
+func TestGetProjectHandlerTracksBackgroundRefreshes(t *testing.T) {
+	mr, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"org/repo": `{"id":2}`})
+	upstream.gate = make(chan struct{})
+	cache := NewLocalCache(CacheOptions{})
+	handler := getProjectHandler(context.Background(), be, cache, upstream)
+
+	stale := cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now().Add(-time.Hour)}
+	mr.HSet("projects", "project:org:repo", stale.encode())
+
+	// The stale project is served right away and refreshed in the background.
+	if rec := get(handler, "/project/{org}/{repo}", "/project/org/repo"); rec.Body.String() != `{"id":1}` {
+		t.Fatalf("GET = %d %q, want the stale project", rec.Code, rec.Body.String())
+	}
+	if waitFor(timeoutContext(t, 50*time.Millisecond), backgroundTasks.Wait) {
+		t.Fatal("background refresh finished while upstream was blocked")
+	}
+	close(upstream.gate)
+	if !waitFor(timeoutContext(t, 5*time.Second), backgroundTasks.Wait) {
+		t.Fatal("background refresh did not finish")
+	}
+	value, _ := cache.Get("project:org:repo")
+	if p, err := decodeProject(value); err != nil || string(p.Data) != `{"id":2}` {
+		t.Fatalf("cached project = %q, want the refreshed one", value)
+	}
+}
+
+// timeoutContext returns a context that is done after d or when the test ends.
+func timeoutContext(t *testing.T, d time.Duration) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	t.Cleanup(cancel)
+	return ctx
+}
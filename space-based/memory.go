@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// expiringValue is a MemoryStore value with an optional expiry.
+type expiringValue struct {
+	value     string
+	expiresAt time.Time
+}
+
+func (v expiringValue) live(now time.Time) bool {
+	return v.expiresAt.IsZero() || now.Before(v.expiresAt)
+}
+
+// MemoryStore is a CentralStore kept in process memory. It follows the
+// semantics of RedisStore, so a single pod can run without Redis, e.g. for
+// local development and handler tests.
+type MemoryStore struct {
+	mu        sync.Mutex
+	projects  map[string]string
+	versions  map[string]uint64
+	terms     map[string][]string
+	index     map[string]map[string]bool // term -> project keys
+	missing   map[string]expiringValue
+	locks     map[string]expiringValue
+	requests  map[string]float64
+	version   uint64
+	updateSeq uint64
+}
+
+// NewMemoryStore creates an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		projects: make(map[string]string),
+		versions: make(map[string]uint64),
+		terms:    make(map[string][]string),
+		index:    make(map[string]map[string]bool),
+		missing:  make(map[string]expiringValue),
+		locks:    make(map[string]expiringValue),
+		requests: make(map[string]float64),
+	}
+}
+
+// View runs fn against the store itself, which is always consistent.
+func (s *MemoryStore) View(fn func(v StoreView) error) error {
+	return fn(s)
+}
+
+// UpdateSeq returns the sequence number of the last published update.
+func (s *MemoryStore) UpdateSeq(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateSeq, nil
+}
+
+// Projects returns the encoded projects of keys, "" for unknown keys.
+func (s *MemoryStore) Projects(ctx context.Context, keys ...string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = s.projects[key]
+	}
+	return values, nil
+}
+
+// ScanProjects passes all projects to fn in batches of bootstrapBatch.
+func (s *MemoryStore) ScanProjects(ctx context.Context, fn func(batch map[string]string) error) error {
+	s.mu.Lock()
+	all := make(map[string]string, len(s.projects))
+	for key, value := range s.projects {
+		all[key] = value
+	}
+	s.mu.Unlock()
+	return scanBatches(all, fn)
+}
+
+// ScanTerms passes the index terms of all projects to fn in batches.
+func (s *MemoryStore) ScanTerms(ctx context.Context, fn func(batch map[string][]string) error) error {
+	s.mu.Lock()
+	all := make(map[string][]string, len(s.terms))
+	for key, terms := range s.terms {
+		all[key] = terms
+	}
+	s.mu.Unlock()
+	return scanBatches(all, fn)
+}
+
+// ScanVersions passes the versions of all keys to fn in batches.
+func (s *MemoryStore) ScanVersions(ctx context.Context, fn func(batch map[string]uint64) error) error {
+	s.mu.Lock()
+	all := make(map[string]uint64, len(s.versions))
+	for key, version := range s.versions {
+		all[key] = version
+	}
+	s.mu.Unlock()
+	return scanBatches(all, fn)
+}
+
+// scanBatches passes the entries of all to fn in batches of bootstrapBatch.
+func scanBatches[V any](all map[string]V, fn func(batch map[string]V) error) error {
+	batch := make(map[string]V)
+	for key, value := range all {
+		batch[key] = value
+		if len(batch) == bootstrapBatch {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = make(map[string]V)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return fn(batch)
+}
+
+// HotKeys returns the n keys with the most requests.
+func (s *MemoryStore) HotKeys(ctx context.Context, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.hotKeys()
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys, nil
+}
+
+// hotKeys returns all counted keys, the most requested first, ordered like
+// ZREVRANGE orders them. s.mu must be held.
+func (s *MemoryStore) hotKeys() []string {
+	keys := make([]string, 0, len(s.requests))
+	for key := range s.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if s.requests[keys[i]] != s.requests[keys[j]] {
+			return s.requests[keys[i]] > s.requests[keys[j]]
+		}
+		return keys[i] > keys[j]
+	})
+	return keys
+}
+
+// QueryIndex returns the project keys having all the given terms.
+func (s *MemoryStore) QueryIndex(ctx context.Context, terms []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.index[terms[0]] {
+		match := true
+		for _, term := range terms[1:] {
+			if !s.index[term][key] {
+				match = false
+				break
+			}
+		}
+		if match {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Project returns the encoded project of key, "" if unknown.
+func (s *MemoryStore) Project(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.projects[key], nil
+}
+
+// ProjectsExist reports for each key whether a project is stored.
+func (s *MemoryStore) ProjectsExist(ctx context.Context, keys []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		_, exists[i] = s.projects[key]
+	}
+	return exists, nil
+}
+
+// StoreVersioned writes a project like storeVersionedScript does in Redis.
+func (s *MemoryStore) StoreVersioned(ctx context.Context, key, value string, version, base uint64, terms []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.versions[key]
+	if base != 0 && current != base {
+		return false, errVersionConflict
+	}
+	if current >= version {
+		return false, nil
+	}
+	s.versions[key] = version
+	if value == "" {
+		delete(s.projects, key)
+	} else {
+		s.projects[key] = value
+	}
+	for _, term := range s.terms[key] {
+		delete(s.index[term], key)
+		if len(s.index[term]) == 0 {
+			delete(s.index, term)
+		}
+	}
+	delete(s.terms, key)
+	if len(terms) > 0 {
+		for _, term := range terms {
+			if s.index[term] == nil {
+				s.index[term] = make(map[string]bool)
+			}
+			s.index[term][key] = true
+		}
+		s.terms[key] = terms
+	}
+	return true, nil
+}
+
+// NextVersion draws a new version.
+func (s *MemoryStore) NextVersion(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	return s.version, nil
+}
+
+// NextUpdateSeq draws the sequence number of the next published update.
+func (s *MemoryStore) NextUpdateSeq(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateSeq++
+	return s.updateSeq, nil
+}
+
+// Missing returns the unexpired not-found markers of keys.
+func (s *MemoryStore) Missing(ctx context.Context, keys ...string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	markers := make([]string, len(keys))
+	for i, key := range keys {
+		if marker, ok := s.missing[key]; ok && marker.live(now) {
+			markers[i] = marker.value
+		}
+	}
+	return markers, nil
+}
+
+// SetMissing stores the not-found marker of key for ttl.
+func (s *MemoryStore) SetMissing(ctx context.Context, key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.missing[key] = expiringValue{value, time.Now().Add(ttl)}
+	return nil
+}
+
+// ClearMissing removes the not-found marker of key.
+func (s *MemoryStore) ClearMissing(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.missing, key)
+	return nil
+}
+
+// TryLock takes the lock of key unless it is held and unexpired.
+func (s *MemoryStore) TryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if lock, ok := s.locks[key]; ok && lock.live(now) {
+		return false, nil
+	}
+	s.locks[key] = expiringValue{token, now.Add(ttl)}
+	return true, nil
+}
+
+// Unlock releases the lock of key if it is still held with token.
+func (s *MemoryStore) Unlock(ctx context.Context, key, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[key].value == token {
+		delete(s.locks, key)
+	}
+	return nil
+}
+
+// Locked reports whether the lock of key is held.
+func (s *MemoryStore) Locked(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, ok := s.locks[key]
+	return ok && lock.live(time.Now()), nil
+}
+
+// CountRequests increments the request counters of keys and keeps the limit
+// keys with the most requests.
+func (s *MemoryStore) CountRequests(ctx context.Context, limit int, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		s.requests[key]++
+	}
+	if len(s.requests) <= limit {
+		return nil
+	}
+	for _, key := range s.hotKeys()[limit:] {
+		delete(s.requests, key)
+	}
+	return nil
+}
+
+// Ping always succeeds.
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing, the data is kept until the process exits.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// memorySubscriptionBuffer is the number of updates a MemorySubscription
+// holds. Further updates are dropped, which the subscriber notices by the
+// gap in sequence numbers.
+const memorySubscriptionBuffer = 1024
+
+// MemoryBroadcaster delivers cache updates to subscribers in the same process.
+type MemoryBroadcaster struct {
+	mu   sync.Mutex
+	subs map[*memorySubscription]bool
+}
+
+// NewMemoryBroadcaster creates a broadcaster without subscribers.
+func NewMemoryBroadcaster() *MemoryBroadcaster {
+	return &MemoryBroadcaster{subs: make(map[*memorySubscription]bool)}
+}
+
+// Publish hands the JSON encoded update to every subscriber.
+func (b *MemoryBroadcaster) Publish(ctx context.Context, update CacheUpdate) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub.events <- UpdateEvent{Payload: string(payload)}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe registers a subscriber, which is established right away.
+func (b *MemoryBroadcaster) Subscribe(ctx context.Context) UpdateSubscription {
+	sub := &memorySubscription{
+		b:      b,
+		events: make(chan UpdateEvent, memorySubscriptionBuffer),
+		closed: make(chan struct{}),
+	}
+	sub.events <- UpdateEvent{Subscribed: true}
+	b.mu.Lock()
+	b.subs[sub] = true
+	b.mu.Unlock()
+	return sub
+}
+
+// errSubscriptionClosed is returned by Receive after Close.
+var errSubscriptionClosed = errors.New("subscription closed")
+
+// memorySubscription is a subscription to a MemoryBroadcaster.
+type memorySubscription struct {
+	b         *MemoryBroadcaster
+	events    chan UpdateEvent
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Receive waits for the next event, the timeout, ctx or Close.
+func (s *memorySubscription) Receive(ctx context.Context, timeout time.Duration) (UpdateEvent, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case event := <-s.events:
+		return event, nil
+	case <-timer.C:
+		return UpdateEvent{}, errReceiveTimeout
+	case <-ctx.Done():
+		return UpdateEvent{}, ctx.Err()
+	case <-s.closed:
+		return UpdateEvent{}, errSubscriptionClosed
+	}
+}
+
+// Close unregisters the subscriber.
+func (s *memorySubscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.b.mu.Lock()
+		delete(s.b.subs, s)
+		s.b.mu.Unlock()
+		close(s.closed)
+	})
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreStoreVersioned(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		value    string
+		version  uint64
+		base     uint64
+		applied  bool
+		conflict bool
+	}{
+		{"v1", 1, 0, true, false},
+		{"v0", 1, 0, false, false}, // not newer
+		{"v2", 2, 1, true, false},
+		{"v3", 3, 1, false, true},  // changed since base
+		{"", 4, 0, true, false},    // delete
+		{"v1", 3, 0, false, false}, // older than the delete
+	} {
+		applied, err := s.StoreVersioned(ctx, "k", tt.value, tt.version, tt.base, []string{"lang:" + tt.value})
+		if applied != tt.applied || (err == errVersionConflict) != tt.conflict {
+			t.Fatalf("StoreVersioned(%q, %d, base %d) = %v, %v", tt.value, tt.version, tt.base, applied, err)
+		}
+	}
+	if values, _ := s.Projects(ctx, "k"); values[0] != "" {
+		t.Fatalf("deleted project = %q", values[0])
+	}
+	exists, _ := s.ProjectsExist(ctx, []string{"k"})
+	if exists[0] {
+		t.Fatal("deleted project still exists")
+	}
+	var versions map[string]uint64
+	s.ScanVersions(ctx, func(batch map[string]uint64) error {
+		versions = batch
+		return nil
+	})
+	if versions["k"] != 4 {
+		t.Fatalf("versions = %v, want the delete kept as tombstone", versions)
+	}
+}
+
+func TestMemoryStoreIndex(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	s.StoreVersioned(ctx, "a", "va", 1, 0, []string{"lang:go", "owner:org"})
+	s.StoreVersioned(ctx, "b", "vb", 2, 0, []string{"lang:go"})
+	s.StoreVersioned(ctx, "a", "va", 3, 0, []string{"lang:rust", "owner:org"})
+
+	query := func(terms ...string) []string {
+		keys, _ := s.QueryIndex(ctx, terms)
+		sort.Strings(keys)
+		return keys
+	}
+	if got := query("lang:go"); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("lang:go = %v, want the old term of a dropped", got)
+	}
+	if got := query("lang:rust", "owner:org"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("lang:rust owner:org = %v", got)
+	}
+	var terms map[string][]string
+	s.ScanTerms(ctx, func(batch map[string][]string) error {
+		terms = batch
+		return nil
+	})
+	if !reflect.DeepEqual(terms["a"], []string{"lang:rust", "owner:org"}) {
+		t.Fatalf("terms = %v", terms)
+	}
+}
+
+func TestMemoryStoreScansInBatches(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	for i := 0; i <= bootstrapBatch; i++ {
+		s.StoreVersioned(ctx, fmt.Sprintf("k%d", i), "v", 1, 0, nil)
+	}
+	var batches, total int
+	s.ScanProjects(ctx, func(batch map[string]string) error {
+		batches++
+		total += len(batch)
+		return nil
+	})
+	if batches != 2 || total != bootstrapBatch+1 {
+		t.Fatalf("scanned %d projects in %d batches", total, batches)
+	}
+}
+
+func TestMemoryStoreMissing(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	s.SetMissing(ctx, "a", "marker", time.Minute)
+	s.SetMissing(ctx, "b", "expired", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if markers, _ := s.Missing(ctx, "a", "b", "c"); !reflect.DeepEqual(markers, []string{"marker", "", ""}) {
+		t.Fatalf("Missing = %q", markers)
+	}
+	s.ClearMissing(ctx, "a")
+	if markers, _ := s.Missing(ctx, "a"); markers[0] != "" {
+		t.Fatalf("cleared marker = %q", markers[0])
+	}
+}
+
+func TestMemoryStoreLocks(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+
+	if ok, _ := s.TryLock(ctx, "k", "t1", time.Minute); !ok {
+		t.Fatal("TryLock of a free lock failed")
+	}
+	if ok, _ := s.TryLock(ctx, "k", "t2", time.Minute); ok {
+		t.Fatal("TryLock of a held lock succeeded")
+	}
+	s.Unlock(ctx, "k", "t2")
+	if held, _ := s.Locked(ctx, "k"); !held {
+		t.Fatal("lock was released with another token")
+	}
+	s.Unlock(ctx, "k", "t1")
+	if held, _ := s.Locked(ctx, "k"); held {
+		t.Fatal("lock was not released")
+	}
+
+	// An expired lock is free again.
+	s.TryLock(ctx, "k", "t3", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := s.TryLock(ctx, "k", "t4", time.Minute); !ok {
+		t.Fatal("TryLock of an expired lock failed")
+	}
+}
+
+func TestMemoryStoreCountRequests(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	s.CountRequests(ctx, 3, "a", "b", "c")
+	s.CountRequests(ctx, 3, "b", "c")
+	s.CountRequests(ctx, 3, "c")
+	if hot, _ := s.HotKeys(ctx, 2); !reflect.DeepEqual(hot, []string{"c", "b"}) {
+		t.Fatalf("HotKeys = %v", hot)
+	}
+
+	// New keys compete with the least requested ones for the kept entries.
+	s.CountRequests(ctx, 3, "d", "d")
+	if hot, _ := s.HotKeys(ctx, 10); !reflect.DeepEqual(hot, []string{"c", "d", "b"}) {
+		t.Fatalf("HotKeys after trimming = %v", hot)
+	}
+}
+
+func TestMemoryBroadcaster(t *testing.T) {
+	b := NewMemoryBroadcaster()
+	ctx := context.Background()
+	sub := b.Subscribe(ctx)
+
+	if event, err := sub.Receive(ctx, time.Second); err != nil || !event.Subscribed {
+		t.Fatalf("first event = %+v, %v, want the subscription", event, err)
+	}
+	if _, err := sub.Receive(ctx, time.Millisecond); err != errReceiveTimeout {
+		t.Fatalf("Receive without updates = %v, want errReceiveTimeout", err)
+	}
+
+	b.Publish(ctx, CacheUpdate{Action: "delete", Key: "k", Version: 2})
+	event, err := sub.Receive(ctx, time.Second)
+	var update CacheUpdate
+	if err != nil || json.Unmarshal([]byte(event.Payload), &update) != nil || update.Key != "k" || update.Version != 2 {
+		t.Fatalf("Receive = %+v, %v", event, err)
+	}
+
+	// Closing interrupts a pending Receive and stops the delivery.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sub.Close()
+	}()
+	if _, err := sub.Receive(ctx, time.Minute); err != errSubscriptionClosed {
+		t.Fatalf("Receive after Close = %v, want errSubscriptionClosed", err)
+	}
+	if err := b.Publish(ctx, CacheUpdate{Action: "set", Key: "k"}); err != nil {
+		t.Fatalf("Publish without subscribers = %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultFreshFor is how long a fetched project is served without revalidation.
+// Older entries are still served, but trigger a background refresh.
+const defaultFreshFor = 5 * time.Minute
+
+// defaultNotFoundTTL is how long the caches remember that a repository does not exist.
+const defaultNotFoundTTL = time.Minute
+
+// defaultUpdatesChannel is the Redis Pub/Sub channel used to synchronize local caches.
+const defaultUpdatesChannel = "cache_updates"
+
+// defaultMaxInlineUpdateBytes is the largest value sent along with a versioned
+// update by default.
+const defaultMaxInlineUpdateBytes = 4096
+
+// cachedProject is the value stored for a project in Redis, the local cache
+// and CacheUpdate messages.
+type cachedProject struct {
+	Data         json.RawMessage `json:"data,omitempty"`
+	NotFound     bool            `json:"not_found,omitempty"`
+	Deleted      bool            `json:"deleted,omitempty"`  // tombstone, only kept in local caches
+	Outdated     bool            `json:"outdated,omitempty"` // a newer version is in Redis, only kept in local caches
+	Version      uint64          `json:"version,omitempty"`
+	FetchedAt    time.Time       `json:"fetched_at"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Annotations  json.RawMessage `json:"annotations,omitempty"` // set by TeamUp users, kept across refreshes
+}
+
+// decodeProject parses a cached value, compressed or not. Values written
+// before metadata was stored hold the bare GitHub JSON and are treated as stale.
+func decodeProject(value string) (cachedProject, error) {
+	raw, err := decompressValue(value)
+	if err != nil {
+		return cachedProject{}, err
+	}
+	var p cachedProject
+	if err := json.Unmarshal(raw, &p); err == nil && (len(p.Data) > 0 || p.NotFound || p.Deleted || p.Outdated) {
+		return p, nil
+	}
+	if !json.Valid(raw) {
+		return cachedProject{}, errors.New("invalid cached project")
+	}
+	return cachedProject{Data: json.RawMessage(raw)}, nil
+}
+
+// encode serializes the project for storage.
+func (p cachedProject) encode() string {
+	value, _ := json.Marshal(p)
+	return string(value)
+}
+
+// body returns the JSON served for the project: the upstream data with the
+// annotations, if any, added as an "annotations" field.
+func (p cachedProject) body() []byte {
+	if len(p.Annotations) == 0 {
+		return p.Data
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(p.Data, &fields); err != nil || fields == nil {
+		return p.Data
+	}
+	fields["annotations"] = p.Annotations
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return p.Data
+	}
+	return body
+}
+
+// stale reports whether the project, trusted for freshFor after it was
+// fetched, should be revalidated with GitHub.
+func (p cachedProject) stale(freshFor time.Duration) bool {
+	return time.Since(p.FetchedAt) > freshFor
+}
+
+// storeProject saves a project to Redis and the local cache. If publish is
+// true a CacheUpdate is sent so that other pods update their local caches.
+// p.Version is the version p was derived from; unless it is zero the write
+// fails with errVersionConflict if the project was changed since. The stored
+// project is returned with its new version.
+func storeProject(ctx context.Context, be *Backend, cache *LocalCache, key string, p cachedProject, publish bool) (cachedProject, error) {
+	base := p.Version
+	p.Data = projectJSON(p.Data, cache.opts.Fields)
+	version, err := be.NextVersion(ctx)
+	if err != nil {
+		// Without a version the value cannot be ordered against other
+		// writes, so it only goes to the local cache.
+		log.Printf("Error drawing version for %s: %v", key, err)
+		cacheProject(cache, key, compressValue(p.encode(), cache.opts.Compression), 0)
+		return p, nil
+	}
+	p.Version = version
+	value := compressValue(p.encode(), cache.opts.Compression)
+
+	// Save the project data in the central cache.
+	terms := p.record(key).terms()
+	applied, err := be.StoreVersioned(ctx, key, value, version, base, terms)
+	if err == errVersionConflict {
+		return p, err
+	} else if err != nil {
+		log.Printf("Error saving project to the central cache: %v", err)
+	} else if !applied {
+		log.Printf("Skipped saving stale version %d of %s", version, key)
+		return p, nil
+	}
+	// Update local cache.
+	cacheProject(cache, key, value, 0)
+
+	// The repository exists (again), forget that it was missing.
+	if err := be.ClearMissing(ctx, key); err != nil {
+		log.Printf("Error clearing not-found marker: %v", err)
+	}
+
+	if !publish {
+		return p, nil
+	}
+
+	// Publish an update event so that other pods can update their local caches.
+	publishUpdate(ctx, be, cache, CacheUpdate{
+		Action:  "set",
+		Key:     key,
+		Value:   value,
+		Version: version,
+		Terms:   terms,
+	})
+	return p, nil
+}
+
+// deleteProject invalidates a project in Redis and all local caches. A
+// project without annotations is removed, so the next request fetches it from
+// upstream again. The annotations of a project must survive, so an annotated
+// project is only marked stale instead: the next request still serves it and
+// revalidates it with upstream unconditionally. Keys that are not stored are
+// left alone.
+func deleteProject(ctx context.Context, be *Backend, cache *LocalCache, key string) error {
+	for attempt := 1; ; attempt++ {
+		value, err := be.Project(ctx, key)
+		if err == nil && value == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := decodeProject(value)
+		if err != nil {
+			return err
+		}
+
+		if len(p.Annotations) > 0 {
+			p.FetchedAt, p.ETag, p.LastModified = time.Time{}, "", ""
+			_, err = storeProject(ctx, be, cache, key, p, true)
+		} else {
+			err = removeProject(ctx, be, cache, key, p.Version)
+		}
+		if err != errVersionConflict || attempt == maxWriteAttempts {
+			return err
+		}
+	}
+}
+
+// removeProject deletes a project from Redis and all local caches. The pods
+// keep a tombstone, so a delayed older update cannot bring it back. Unless
+// base is zero it fails with errVersionConflict if the project was changed
+// since version base.
+func removeProject(ctx context.Context, be *Backend, cache *LocalCache, key string, base uint64) error {
+	version, err := be.NextVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := be.StoreVersioned(ctx, key, "", version, base, nil); err != nil {
+		return err
+	}
+	if err := be.ClearMissing(ctx, key); err != nil {
+		log.Printf("Error clearing not-found marker: %v", err)
+	}
+	cacheTombstone(cache, key, version)
+
+	publishUpdate(ctx, be, cache, CacheUpdate{
+		Action:  "delete",
+		Key:     key,
+		Version: version,
+	})
+	return nil
+}
+
+// projectKey returns the key "project:{org}:{repo}" of a repository. GitHub
+// names are case-insensitive, so keys are lower case and every spelling of a
+// name finds the same project.
+func projectKey(org, repo string) string {
+	return "project:" + strings.ToLower(org) + ":" + strings.ToLower(repo)
+}
+
+// missingKey returns the Redis key of the not-found marker of a project key.
+// Markers are kept outside the "projects" hash so that Redis expires them.
+func missingKey(key string) string {
+	return "missing:" + key
+}
+
+// storeMissing remembers in Redis and the local cache that a project does not
+// exist upstream and tells the other pods, so that requests for it are answered
+// without asking upstream again until the not-found TTL has passed.
+func storeMissing(ctx context.Context, be *Backend, cache *LocalCache, key string) {
+	version, err := be.NextVersion(ctx)
+	if err != nil {
+		log.Printf("Error drawing version for %s: %v", key, err)
+		cacheProject(cache, key, cachedProject{NotFound: true, FetchedAt: time.Now()}.encode(), cache.opts.NotFoundTTL)
+		return
+	}
+	value := cachedProject{NotFound: true, FetchedAt: time.Now(), Version: version}.encode()
+
+	// A deleted repository must not be served from the hash anymore. Names
+	// that never existed get no version, versions are kept forever while the
+	// marker expires.
+	if current, err := be.Project(ctx, key); err != nil {
+		log.Printf("Error reading project from the central cache: %v", err)
+	} else if current != "" {
+		if applied, err := be.StoreVersioned(ctx, key, "", version, 0, nil); err != nil {
+			log.Printf("Error removing project from Redis: %v", err)
+		} else if !applied {
+			log.Printf("Skipped saving stale not-found marker %d of %s", version, key)
+			return
+		}
+	}
+	if err := be.SetMissing(ctx, key, value, cache.opts.NotFoundTTL); err != nil {
+		log.Printf("Error saving not-found marker to Redis: %v", err)
+	}
+	cacheProject(cache, key, value, cache.opts.NotFoundTTL)
+
+	publishUpdate(ctx, be, cache, CacheUpdate{
+		Action:  "set",
+		Key:     key,
+		Value:   value,
+		TTL:     int(cache.opts.NotFoundTTL / time.Second),
+		Version: version,
+	})
+}
+
+// getMissing returns the not-found marker of a project key from Redis, if any,
+// and copies it to the local cache for the rest of its lifetime.
+func getMissing(ctx context.Context, be *Backend, cache *LocalCache, key string) (string, bool) {
+	markers, err := be.Missing(ctx, key)
+	if err != nil {
+		log.Printf("Central cache error: %v", err)
+		return "", false
+	}
+	value := markers[0]
+	if value == "" || !cacheMissing(cache, key, value) {
+		return "", false
+	}
+	return value, true
+}
+
+// cacheMissing copies a not-found marker read from Redis to the local cache
+// for the rest of its lifetime. It reports false if the marker is unusable.
+func cacheMissing(cache *LocalCache, key, value string) bool {
+	p, err := decodeProject(value)
+	if err != nil {
+		return false
+	}
+	ttl := time.Until(p.FetchedAt.Add(cache.opts.NotFoundTTL))
+	if ttl <= 0 {
+		return false
+	}
+	cacheProject(cache, key, value, ttl)
+	return true
+}
+
+// publishUpdate broadcasts a cache update to all pods. Versioned values larger
+// than the cache's MaxInlineUpdateBytes are left out and loaded from the
+// central cache when needed.
+func publishUpdate(ctx context.Context, be *Backend, cache *LocalCache, update CacheUpdate) {
+	if update.Version > 0 && len(update.Value) > cache.opts.MaxInlineUpdateBytes {
+		update.Value = ""
+	} else {
+		// Receivers derive the terms from the value.
+		update.Terms = nil
+	}
+
+	seq, err := be.NextUpdateSeq(ctx)
+	if err != nil {
+		log.Printf("Error drawing update sequence: %v", err)
+	}
+	update.Seq = seq
+
+	if err := be.Publish(ctx, update); err != nil {
+		log.Printf("Error publishing cache update: %v", err)
+	}
+}
+
+// fetchProject loads a project from upstream, saves it to both caches and
+// publishes an update. A lock in the central cache makes sure only one pod queries upstream for a
+// key at a time; the other pods wait for its result. The stored project is returned.
+func fetchProject(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, key string) (cachedProject, error) {
+	token, err := acquireFetchLock(ctx, be, key)
+	if err != nil {
+		// Without the central cache we cannot coordinate, fetch anyway.
+		log.Printf("Error acquiring fetch lock: %v", err)
+	} else if token == "" {
+		if value, ok := waitForFetch(ctx, be, key); ok {
+			if p, err := decodeProject(value); err == nil {
+				if p.NotFound {
+					return cachedProject{}, ErrProjectNotFound
+				}
+				cacheProject(cache, key, value, 0)
+				return p, nil
+			}
+		}
+	} else {
+		defer func() {
+			if err := releaseFetchLock(context.WithoutCancel(ctx), be, key, token); err != nil {
+				log.Printf("Error releasing fetch lock: %v", err)
+			}
+		}()
+		// Another pod may have stored the project just before we got the lock.
+		if value, err := be.Project(ctx, key); err == nil && value != "" {
+			if p, err := decodeProject(value); err == nil {
+				cacheProject(cache, key, value, 0)
+				return p, nil
+			}
+		}
+	}
+
+	p, _, err := upstream.FetchProject(ctx, org, repo, nil)
+	if errors.Is(err, ErrProjectNotFound) {
+		storeMissing(ctx, be, cache, key)
+		return cachedProject{}, err
+	}
+	if err != nil {
+		return cachedProject{}, err
+	}
+	p, err = storeProject(ctx, be, cache, key, p, true)
+	if err != nil {
+		return cachedProject{}, err
+	}
+	return p, nil
+}
+
+// refreshProject revalidates a stale project with a conditional upstream request.
+// Other pods are only notified if the content actually changed, so they find
+// an unchanged revalidation in Redis and take it from there instead of asking
+// upstream again. force skips that check, e.g. when GitHub announced a change.
+func refreshProject(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, key string, prev cachedProject, force bool) {
+	token, err := acquireFetchLock(ctx, be, key)
+	if err != nil {
+		log.Printf("Error acquiring fetch lock: %v", err)
+	} else if token == "" {
+		// Another pod is already fetching this project.
+		return
+	} else {
+		defer func() {
+			if err := releaseFetchLock(context.WithoutCancel(ctx), be, key, token); err != nil {
+				log.Printf("Error releasing fetch lock: %v", err)
+			}
+		}()
+	}
+
+	if value, err := be.Project(ctx, key); err == nil && value != "" {
+		if current, err := decodeProject(value); err == nil {
+			if !force && !current.stale(cache.opts.FreshFor) {
+				cacheProject(cache, key, value, 0)
+				return
+			}
+			prev = current
+		}
+	}
+
+	p, changed, err := upstream.FetchProject(ctx, org, repo, &prev)
+	if errors.Is(err, ErrProjectNotFound) {
+		log.Printf("Project %s was removed upstream", key)
+		storeMissing(ctx, be, cache, key)
+		return
+	}
+	if err != nil {
+		log.Printf("Error refreshing %s: %v", key, err)
+		return
+	}
+	// Keep the annotations, and do not overwrite changes made since prev was read.
+	p.Annotations = prev.Annotations
+	p.Version = prev.Version
+	if _, err := storeProject(ctx, be, cache, key, p, changed); err != nil {
+		log.Printf("Skipped refresh of %s: %v", key, err)
+		return
+	}
+	log.Printf("Refreshed %s (changed: %t)", key, changed)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDecodeProject(t *testing.T) {
+	fetchedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	stored := cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: fetchedAt, ETag: `"abc"`}
+
+	p, err := decodeProject(stored.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != `{"id":1}` || !p.FetchedAt.Equal(fetchedAt) || p.ETag != `"abc"` {
+		t.Fatalf("decodeProject = %+v", p)
+	}
+
+	// Values written before metadata was stored are bare GitHub JSON.
+	p, err = decodeProject(`{"id":2}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Data) != `{"id":2}` || !p.stale(defaultFreshFor) {
+		t.Fatalf("decodeProject(legacy) = %+v, want stale bare data", p)
+	}
+
+	if _, err := decodeProject("not json"); err == nil {
+		t.Fatal("decodeProject accepted invalid JSON")
+	}
+}
+
+func TestCachedProjectStale(t *testing.T) {
+	if p := (cachedProject{FetchedAt: time.Now()}); p.stale(defaultFreshFor) {
+		t.Fatal("a project fetched now is stale")
+	}
+	if p := (cachedProject{FetchedAt: time.Now().Add(-defaultFreshFor - time.Second)}); !p.stale(defaultFreshFor) {
+		t.Fatal("a project older than its fresh time is not stale")
+	}
+}
+
+// TestRefreshProjectUsesFreshRevalidation checks that a pod does not ask
+// GitHub again when another pod already revalidated the project.
+func TestRefreshProjectUsesFreshRevalidation(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+	const key = "project:org:repo"
+
+	stale := cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now().Add(-time.Hour)}
+	fresh := cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now()}
+	cache.Set(key, stale.encode())
+	mr.HSet("projects", key, fresh.encode())
+
+	upstream := newFakeUpstream(nil)
+	refreshProject(context.Background(), be, cache, upstream, "org", "repo", key, stale, false)
+
+	value, ok := cache.Get(key)
+	if !ok || value != fresh.encode() {
+		t.Fatalf("local cache holds %q, want the revalidated project", value)
+	}
+	if calls := upstream.Calls(); calls != 0 {
+		t.Fatalf("upstream got %d requests, want 0", calls)
+	}
+	if mr.Exists(fetchLockKey(key)) {
+		t.Fatal("fetch lock was not released")
+	}
+}
+
+func TestStoreMissing(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+	const key = "project:org:repo"
+	mr.HSet("projects", key, cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now()}.encode())
+
+	sub := be.Subscribe(context.Background())
+	defer sub.Close()
+	if _, err := sub.Receive(context.Background(), time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	storeMissing(context.Background(), be, cache, key)
+
+	if mr.HGet("projects", key) != "" {
+		t.Fatal("deleted project is still in the projects hash")
+	}
+	if ttl := mr.TTL(missingKey(key)); ttl != defaultNotFoundTTL {
+		t.Fatalf("marker TTL = %v, want %v", ttl, defaultNotFoundTTL)
+	}
+	value, ok := cache.Get(key)
+	if p, err := decodeProject(value); !ok || err != nil || !p.NotFound {
+		t.Fatalf("local cache holds %q, want a not-found marker", value)
+	}
+
+	event, err := sub.Receive(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var update CacheUpdate
+	if err := json.Unmarshal([]byte(event.Payload), &update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Action != "set" || update.Key != key || update.Value != value || update.TTL != int(defaultNotFoundTTL/time.Second) {
+		t.Fatalf("published %+v", update)
+	}
+
+	// Another pod finds the marker in Redis.
+	other := NewLocalCache(CacheOptions{})
+	if got, ok := getMissing(context.Background(), be, other, key); !ok || got != value {
+		t.Fatalf("getMissing = %q, %v", got, ok)
+	}
+	if _, ok := other.Get(key); !ok {
+		t.Fatal("getMissing did not cache the marker locally")
+	}
+
+	// The repository reappears.
+	storeProject(context.Background(), be, cache, key, cachedProject{Data: json.RawMessage(`{"id":2}`), FetchedAt: time.Now()}, false)
+	if mr.Exists(missingKey(key)) {
+		t.Fatal("storeProject kept the not-found marker")
+	}
+}
+
+func TestGetMissingIgnoresExpiredMarkers(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+	expired := cachedProject{NotFound: true, FetchedAt: time.Now().Add(-defaultNotFoundTTL)}
+	mr.Set(missingKey("project:org:repo"), expired.encode())
+
+	if value, ok := getMissing(context.Background(), be, cache, "project:org:repo"); ok {
+		t.Fatalf("getMissing = %q, want no marker", value)
+	}
+}
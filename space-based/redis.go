@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis deployment modes supported by RedisConfig.Mode.
+const (
+	redisStandalone = "standalone"
+	redisSentinel   = "sentinel"
+	redisCluster    = "cluster"
+)
+
+// projectsKey is the Redis hash holding the encoded project of every key.
+const projectsKey = "projects"
+
+// redisKeys names the Redis keys holding the projects and their indexes.
+type redisKeys struct {
+	projects    string // encoded project of every key
+	versions    string // latest version of every key
+	terms       string // index terms of every key
+	indexPrefix string // prefix of the sets holding the keys with a term
+}
+
+// indexSet returns the Redis set holding the project keys with a term.
+func (k redisKeys) indexSet(term string) string {
+	return k.indexPrefix + term
+}
+
+// standaloneKeys are the key names used with a single master.
+var standaloneKeys = redisKeys{
+	projects:    projectsKey,
+	versions:    versionsKey,
+	terms:       projectTermsKey,
+	indexPrefix: indexKeyPrefix,
+}
+
+// clusterKeys share the {projects} hash tag, so that the keys touched
+// together by one script or command are in the same cluster slot.
+var clusterKeys = redisKeys{
+	projects:    "{projects}",
+	versions:    "{projects}:versions",
+	terms:       "{projects}:terms",
+	indexPrefix: "{projects}:idx:",
+}
+
+// RedisClient is the connection to the central cache. Commands on the
+// embedded client go to the master; reads that may lag slightly behind use
+// read, which prefers a replica and falls back to the master.
+type RedisClient struct {
+	redis.UniversalClient
+	keys     redisKeys
+	replicas []redis.UniversalClient
+	next     atomic.Uint32
+}
+
+// newRedisClient connects to Redis as configured. Connections are made
+// lazily, so an unreachable Redis is only reported by the first command.
+func newRedisClient(cfg RedisConfig) *RedisClient {
+	var dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+	if cfg.TLS {
+		dialer = tlsDialer(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	switch cfg.Mode {
+	case redisSentinel:
+		opts := &redis.FailoverOptions{
+			MasterName:    cfg.MasterName,
+			SentinelAddrs: cfg.Addrs,
+			Password:      cfg.Password,
+			DB:            cfg.DB,
+			Dialer:        dialer,
+		}
+		c := &RedisClient{UniversalClient: redis.NewFailoverClient(opts), keys: standaloneKeys}
+		replicaOpts := *opts
+		replicaOpts.SlaveOnly = true
+		c.replicas = []redis.UniversalClient{redis.NewFailoverClient(&replicaOpts)}
+		return c
+	case redisCluster:
+		// The cluster client routes read-only commands to replicas itself.
+		return &RedisClient{UniversalClient: redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:         cfg.Addrs,
+			Password:      cfg.Password,
+			Dialer:        dialer,
+			RouteRandomly: true,
+		}), keys: clusterKeys}
+	default:
+		c := &RedisClient{UniversalClient: redis.NewClient(&redis.Options{
+			Addr:     cfg.Addr,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+			Dialer:   dialer,
+		}), keys: standaloneKeys}
+		for _, addr := range cfg.Replicas {
+			c.replicas = append(c.replicas, redis.NewClient(&redis.Options{
+				Addr:     addr,
+				Password: cfg.Password,
+				DB:       cfg.DB,
+				Dialer:   dialer,
+			}))
+		}
+		return c
+	}
+}
+
+// tlsDialer returns a dialer that verifies each server against its own host name.
+func tlsDialer(base *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	netDialer := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 5 * time.Minute}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		cfg := base.Clone()
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		d := &tls.Dialer{NetDialer: netDialer, Config: cfg}
+		return d.DialContext(ctx, network, addr)
+	}
+}
+
+// replica returns the next replica in turn, or nil if there are none.
+func (c *RedisClient) replica() redis.UniversalClient {
+	if len(c.replicas) == 0 {
+		return nil
+	}
+	n := c.next.Add(1)
+	return c.replicas[int(n)%len(c.replicas)]
+}
+
+// read runs fn against a replica, and again against the master if the
+// replica fails. All commands of fn see the same server, so they observe a
+// consistent state. redis.Nil is a result, not a failure.
+func (c *RedisClient) read(fn func(r redis.UniversalClient) error) error {
+	if replica := c.replica(); replica != nil {
+		err := fn(replica)
+		if err == nil || err == redis.Nil {
+			return err
+		}
+		log.Printf("Replica read failed, using master: %v", err)
+	}
+	return fn(c.UniversalClient)
+}
+
+// Close closes the connections to the master and all replicas.
+func (c *RedisClient) Close() error {
+	errs := []error{c.UniversalClient.Close()}
+	for _, replica := range c.replicas {
+		errs = append(errs, replica.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// redisView reads the central cache from one Redis server.
+type redisView struct {
+	r      redis.UniversalClient
+	keys   redisKeys
+	seqKey string
+}
+
+// UpdateSeq returns the sequence number of the last published update.
+func (v redisView) UpdateSeq(ctx context.Context) (uint64, error) {
+	seq, err := v.r.Get(ctx, v.seqKey).Uint64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// Projects reads the projects of keys with a single HMGET.
+func (v redisView) Projects(ctx context.Context, keys ...string) ([]string, error) {
+	values, err := v.r.HMGet(ctx, v.keys.projects, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	projects := make([]string, len(values))
+	for i, value := range values {
+		projects[i], _ = value.(string)
+	}
+	return projects, nil
+}
+
+// ScanProjects scans the projects hash.
+func (v redisView) ScanProjects(ctx context.Context, fn func(batch map[string]string) error) error {
+	return scanHash(ctx, v.r, v.keys.projects, fn)
+}
+
+// ScanTerms scans the hash of stored index terms.
+func (v redisView) ScanTerms(ctx context.Context, fn func(batch map[string][]string) error) error {
+	return scanHash(ctx, v.r, v.keys.terms, func(batch map[string]string) error {
+		terms := make(map[string][]string, len(batch))
+		for key, t := range batch {
+			terms[key] = strings.Split(t, "\n")
+		}
+		return fn(terms)
+	})
+}
+
+// HotKeys reads the top of the hot keys sorted set.
+func (v redisView) HotKeys(ctx context.Context, n int) ([]string, error) {
+	return v.r.ZRevRange(ctx, hotKeysKey, 0, int64(n)-1).Result()
+}
+
+// QueryIndex intersects the index sets of terms.
+func (v redisView) QueryIndex(ctx context.Context, terms []string) ([]string, error) {
+	setKeys := make([]string, len(terms))
+	for i, term := range terms {
+		setKeys[i] = v.keys.indexSet(term)
+	}
+	return v.r.SInter(ctx, setKeys...).Result()
+}
+
+// scanHash passes the fields of a Redis hash to fn in batches of about
+// bootstrapBatch. Fields changed during the scan may be passed twice.
+func scanHash(ctx context.Context, r redis.Cmdable, key string, fn func(batch map[string]string) error) error {
+	var cursor uint64
+	for {
+		pairs, next, err := r.HScan(ctx, key, cursor, "", bootstrapBatch).Result()
+		if err != nil {
+			return err
+		}
+		batch := make(map[string]string, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			batch[pairs[i]] = pairs[i+1]
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// RedisStore is the CentralStore kept in Redis. Projects and QueryIndex
+// prefer a replica; everything else uses the master.
+type RedisStore struct {
+	redisView
+	c *RedisClient
+}
+
+// NewRedisStore keeps the central cache in the Redis behind c. The update
+// sequence numbers are counted per updates channel.
+func NewRedisStore(c *RedisClient, channel string) *RedisStore {
+	return &RedisStore{redisView: redisView{c.UniversalClient, c.keys, updateSeqKey(channel)}, c: c}
+}
+
+// View runs fn against a replica, or the master if the replica fails.
+func (s *RedisStore) View(fn func(v StoreView) error) error {
+	return s.c.read(func(r redis.UniversalClient) error {
+		return fn(redisView{r, s.keys, s.seqKey})
+	})
+}
+
+// Projects reads the projects of keys, preferably from a replica.
+func (s *RedisStore) Projects(ctx context.Context, keys ...string) (projects []string, err error) {
+	err = s.View(func(v StoreView) error {
+		projects, err = v.Projects(ctx, keys...)
+		return err
+	})
+	return projects, err
+}
+
+// QueryIndex intersects the index sets of terms, preferably on a replica.
+func (s *RedisStore) QueryIndex(ctx context.Context, terms []string) (keys []string, err error) {
+	err = s.View(func(v StoreView) error {
+		keys, err = v.QueryIndex(ctx, terms)
+		return err
+	})
+	return keys, err
+}
+
+// Project reads the project of key from the master.
+func (s *RedisStore) Project(ctx context.Context, key string) (string, error) {
+	value, err := s.c.HGet(ctx, s.keys.projects, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return value, err
+}
+
+// ProjectsExist checks the keys with pipelined HEXISTS.
+func (s *RedisStore) ProjectsExist(ctx context.Context, keys []string) ([]bool, error) {
+	cmds := make([]*redis.BoolCmd, len(keys))
+	_, err := s.c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HExists(ctx, s.keys.projects, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	exists := make([]bool, len(keys))
+	for i, cmd := range cmds {
+		exists[i] = cmd.Val()
+	}
+	return exists, nil
+}
+
+// ScanVersions scans the versions hash.
+func (s *RedisStore) ScanVersions(ctx context.Context, fn func(batch map[string]uint64) error) error {
+	return scanHash(ctx, s.c, s.keys.versions, func(batch map[string]string) error {
+		versions := make(map[string]uint64, len(batch))
+		for key, v := range batch {
+			if version, err := strconv.ParseUint(v, 10, 64); err == nil {
+				versions[key] = version
+			}
+		}
+		return fn(versions)
+	})
+}
+
+// storeVersionedScript writes a project value (or deletes it if the value is
+// empty) only if its version is newer than the stored one and, if a base
+// version is given, the stored version still equals it. The secondary index
+// sets, named by the prefix in ARGV[6], are updated with the newline
+// separated terms in the same step. It returns 1 if the write was applied, 0
+// if it was stale and -1 if the base did not match.
+var storeVersionedScript = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[2], ARGV[1]) or "0")
+if ARGV[4] ~= "0" and current ~= tonumber(ARGV[4]) then
+	return -1
+end
+if current >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+if ARGV[3] == "" then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+else
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+end
+local old = redis.call("HGET", KEYS[3], ARGV[1])
+if old then
+	for term in string.gmatch(old, "[^\n]+") do
+		redis.call("SREM", ARGV[6] .. term, ARGV[1])
+	end
+end
+if ARGV[5] == "" then
+	redis.call("HDEL", KEYS[3], ARGV[1])
+else
+	for term in string.gmatch(ARGV[5], "[^\n]+") do
+		redis.call("SADD", ARGV[6] .. term, ARGV[1])
+	end
+	redis.call("HSET", KEYS[3], ARGV[1], ARGV[5])
+end
+return 1
+`)
+
+// StoreVersioned writes the project and its index terms with a Lua script,
+// so that the version check and the write are atomic.
+func (s *RedisStore) StoreVersioned(ctx context.Context, key, value string, version, base uint64, terms []string) (bool, error) {
+	keys := []string{s.keys.projects, s.keys.versions, s.keys.terms}
+	applied, err := storeVersionedScript.Run(ctx, s.c, keys, key, version, value, base, strings.Join(terms, "\n"), s.keys.indexPrefix).Int()
+	if err == nil && applied == -1 {
+		return false, errVersionConflict
+	}
+	return applied == 1, err
+}
+
+// NextVersion increments the version counter.
+func (s *RedisStore) NextVersion(ctx context.Context) (uint64, error) {
+	v, err := s.c.Incr(ctx, versionCounterKey).Result()
+	return uint64(v), err
+}
+
+// NextUpdateSeq increments the update sequence counter.
+func (s *RedisStore) NextUpdateSeq(ctx context.Context) (uint64, error) {
+	seq, err := s.c.Incr(ctx, s.seqKey).Result()
+	return uint64(seq), err
+}
+
+// Missing reads the not-found markers with pipelined GETs.
+func (s *RedisStore) Missing(ctx context.Context, keys ...string) ([]string, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	s.c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, missingKey(key))
+		}
+		return nil
+	})
+	markers := make([]string, len(keys))
+	for i, cmd := range cmds {
+		value, err := cmd.Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		markers[i] = value
+	}
+	return markers, nil
+}
+
+// SetMissing stores the marker in its own key, so that Redis expires it.
+func (s *RedisStore) SetMissing(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.c.Set(ctx, missingKey(key), value, ttl).Err()
+}
+
+// ClearMissing deletes the marker key.
+func (s *RedisStore) ClearMissing(ctx context.Context, key string) error {
+	return s.c.Del(ctx, missingKey(key)).Err()
+}
+
+// TryLock sets the lock key if it does not exist.
+func (s *RedisStore) TryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return s.c.SetNX(ctx, fetchLockKey(key), token, ttl).Result()
+}
+
+// releaseLockScript deletes the lock only if it is still held by the given token.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Unlock deletes the lock key with a Lua script if it still holds token.
+func (s *RedisStore) Unlock(ctx context.Context, key, token string) error {
+	return releaseLockScript.Run(ctx, s.c, []string{fetchLockKey(key)}, token).Err()
+}
+
+// Locked checks whether the lock key exists.
+func (s *RedisStore) Locked(ctx context.Context, key string) (bool, error) {
+	n, err := s.c.Exists(ctx, fetchLockKey(key)).Result()
+	return n > 0, err
+}
+
+// CountRequests increments the keys in the hot keys sorted set and trims it
+// to limit entries in one round trip.
+func (s *RedisStore) CountRequests(ctx context.Context, limit int, keys ...string) error {
+	_, err := s.c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.ZIncrBy(ctx, hotKeysKey, 1, key)
+		}
+		pipe.ZRemRangeByRank(ctx, hotKeysKey, 0, -int64(limit)-1)
+		return nil
+	})
+	return err
+}
+
+// Ping pings the master.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.c.Ping(ctx).Err()
+}
+
+// Close closes all connections.
+func (s *RedisStore) Close() error {
+	return s.c.Close()
+}
+
+// RedisBroadcaster sends cache updates over a Redis Pub/Sub channel.
+type RedisBroadcaster struct {
+	c       *RedisClient
+	channel string
+}
+
+// NewRedisBroadcaster publishes updates on channel of the Redis master.
+func NewRedisBroadcaster(c *RedisClient, channel string) *RedisBroadcaster {
+	return &RedisBroadcaster{c: c, channel: channel}
+}
+
+// Publish sends the JSON encoded update.
+func (b *RedisBroadcaster) Publish(ctx context.Context, update CacheUpdate) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return b.c.Publish(ctx, b.channel, string(payload)).Err()
+}
+
+// Subscribe subscribes to the channel. The client reconnects by itself.
+func (b *RedisBroadcaster) Subscribe(ctx context.Context) UpdateSubscription {
+	return redisSubscription{b.c.Subscribe(ctx, b.channel)}
+}
+
+// redisSubscription adapts a Redis Pub/Sub subscription.
+type redisSubscription struct {
+	pubsub *redis.PubSub
+}
+
+// Receive reports subscription confirmations, which Redis sends after every
+// reconnect, and messages. Other events are skipped.
+func (s redisSubscription) Receive(ctx context.Context, timeout time.Duration) (UpdateEvent, error) {
+	for {
+		received, err := s.pubsub.ReceiveTimeout(ctx, timeout)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return UpdateEvent{}, errReceiveTimeout
+		}
+		if err != nil {
+			return UpdateEvent{}, err
+		}
+		switch m := received.(type) {
+		case *redis.Subscription:
+			return UpdateEvent{Subscribed: true}, nil
+		case *redis.Message:
+			return UpdateEvent{Payload: m.Payload}, nil
+		}
+	}
+}
+
+// Close unsubscribes and closes the connection.
+func (s redisSubscription) Close() error {
+	return s.pubsub.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestReplicatedRedis returns a client for a master with one replica. The
+// servers do not replicate; tests write to each of them directly.
+func newTestReplicatedRedis(t *testing.T) (master, replica *miniredis.Miniredis, rdb *RedisClient) {
+	t.Helper()
+	master = miniredis.RunT(t)
+	replica = miniredis.RunT(t)
+	rdb = newRedisClient(RedisConfig{Mode: redisStandalone, Addr: master.Addr(), Replicas: []string{replica.Addr()}})
+	t.Cleanup(func() { rdb.Close() })
+	return master, replica, rdb
+}
+
+func TestRedisStoreReadsFromReplicas(t *testing.T) {
+	ctx := context.Background()
+	master, replica, rdb := newTestReplicatedRedis(t)
+	store := NewRedisStore(rdb, defaultUpdatesChannel)
+	master.HSet(projectsKey, "k", "master")
+	replica.HSet(projectsKey, "k", "replica")
+
+	if values, err := store.Projects(ctx, "k", "other"); err != nil || values[0] != "replica" || values[1] != "" {
+		t.Fatalf("Projects = %q, %v, want the replica's value", values, err)
+	}
+	// Reads that must not lag behind go to the master.
+	if value, err := store.Project(ctx, "k"); err != nil || value != "master" {
+		t.Fatalf("Project = %q, %v, want the master's value", value, err)
+	}
+	// Writes go to the master.
+	if _, err := store.StoreVersioned(ctx, "w", "1", 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if master.HGet(projectsKey, "w") != "1" || replica.HGet(projectsKey, "w") != "" {
+		t.Fatal("write did not go to the master only")
+	}
+
+	replica.Close()
+	if values, err := store.Projects(ctx, "k"); err != nil || values[0] != "master" {
+		t.Fatalf("Projects with the replica down = %q, %v, want the master's value", values, err)
+	}
+}
+
+func TestBootstrapCacheReadsOneServer(t *testing.T) {
+	master, replica, rdb := newTestReplicatedRedis(t)
+	master.Set(updateSeqKey(defaultUpdatesChannel), "9")
+	master.HSet(projectsKey, "project:org:new", cachedProject{Version: 2}.encode())
+	replica.Set(updateSeqKey(defaultUpdatesChannel), "4")
+	replica.HSet(projectsKey, "project:org:old", cachedProject{Version: 1}.encode())
+
+	// A lagging replica must not pair its data with the master's sequence,
+	// or the updates in between would never be applied.
+	cache := NewLocalCache(CacheOptions{})
+	seq, err := bootstrapCache(context.Background(), newRedisBackend(rdb, defaultUpdatesChannel), cache)
+	if err != nil || seq != 4 {
+		t.Fatalf("bootstrapCache = %d, %v, want the replica's sequence 4", seq, err)
+	}
+	if _, ok := cache.Get("project:org:old"); !ok {
+		t.Fatal("projects were not loaded from the replica")
+	}
+}
+
+func TestRedisClientKeys(t *testing.T) {
+	for _, tt := range []struct {
+		cfg  RedisConfig
+		want redisKeys
+	}{
+		{RedisConfig{Mode: redisStandalone, Addr: "localhost:6379"}, standaloneKeys},
+		{RedisConfig{Mode: redisSentinel, Addrs: []string{"localhost:26379"}, MasterName: "m"}, standaloneKeys},
+		{RedisConfig{Mode: redisCluster, Addrs: []string{"localhost:7000"}}, clusterKeys},
+	} {
+		rdb := newRedisClient(tt.cfg)
+		if rdb.keys != tt.want {
+			t.Errorf("%s keys = %+v, want %+v", tt.cfg.Mode, rdb.keys, tt.want)
+		}
+		rdb.Close()
+	}
+
+	// Every key a script touches must hash to the same slot.
+	for _, key := range []string{clusterKeys.projects, clusterKeys.versions, clusterKeys.terms, clusterKeys.indexSet("lang:go")} {
+		if !strings.HasPrefix(key, "{projects}") {
+			t.Errorf("cluster key %q lacks the {projects} hash tag", key)
+		}
+	}
+}
+
+func TestStoreVersionedUsesClientKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := &RedisClient{UniversalClient: redis.NewClient(&redis.Options{Addr: mr.Addr()}), keys: clusterKeys}
+	t.Cleanup(func() { rdb.Close() })
+	store := NewRedisStore(rdb, defaultUpdatesChannel)
+
+	if _, err := store.StoreVersioned(context.Background(), "k", "v", 1, 0, []string{"lang:go"}); err != nil {
+		t.Fatalf("StoreVersioned: %v", err)
+	}
+	if mr.HGet("{projects}", "k") != "v" || mr.HGet("{projects}:versions", "k") != "1" || mr.HGet("{projects}:terms", "k") != "lang:go" {
+		t.Fatal("project was not stored under the cluster keys")
+	}
+	if ok, _ := mr.SIsMember("{projects}:idx:lang:go", "k"); !ok {
+		t.Fatal("index set was not stored under the cluster prefix")
+	}
+	if mr.Exists(projectsKey) || mr.Exists(versionsKey) {
+		t.Fatal("standalone keys were written")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// updateSeqKey returns the Redis counter numbering the messages on channel.
+func updateSeqKey(channel string) string {
+	return channel + ":seq"
+}
+
+// gapGrace is how long a missing sequence number may stay missing before the
+// local cache is resynced. Concurrent publishers can deliver messages slightly
+// out of order, so a gap is not treated as lost right away.
+const gapGrace = 2 * time.Second
+
+// maxTrackedGap is the largest gap tracked number by number; larger gaps
+// trigger a resync immediately.
+const maxTrackedGap = 1000
+
+// seqTracker detects lost messages from gaps in update sequence numbers.
+type seqTracker struct {
+	next    uint64               // sequence number expected next
+	missing map[uint64]time.Time // skipped numbers and when they were skipped
+}
+
+// reset starts tracking after the given sequence number.
+func (t *seqTracker) reset(seq uint64) {
+	t.next = seq + 1
+	t.missing = make(map[uint64]time.Time)
+}
+
+// observe records a received sequence number. It reports true if updates
+// were certainly lost and the cache must be resynced.
+func (t *seqTracker) observe(seq uint64) bool {
+	if seq == 0 {
+		// Published without a sequence number.
+		return false
+	}
+	if seq < t.next {
+		delete(t.missing, seq)
+		return false
+	}
+	if seq-t.next > maxTrackedGap {
+		t.reset(seq)
+		return true
+	}
+	now := time.Now()
+	for s := t.next; s < seq; s++ {
+		t.missing[s] = now
+	}
+	t.next = seq + 1
+	return false
+}
+
+// expired reports whether a skipped sequence number has not arrived within gapGrace.
+func (t *seqTracker) expired() bool {
+	for _, skipped := range t.missing {
+		if time.Since(skipped) > gapGrace {
+			return true
+		}
+	}
+	return false
+}
+
+// resyncCache reloads the local cache from the central cache after updates
+// may have been missed. Local values older than the stored version are
+// dropped, or replaced by tombstones if the key was deleted. Keys the pod does not hold
+// need no tombstone, deleted ones are only dropped from the index. Like
+// bootstrapCache it returns the update sequence number the cache is at.
+func resyncCache(ctx context.Context, be *Backend, cache *LocalCache) (uint64, error) {
+	seq, err := bootstrapCache(ctx, be, cache)
+	if err != nil {
+		return 0, err
+	}
+
+	err = be.ScanVersions(ctx, func(batch map[string]uint64) error {
+		// Only keys the local cache is not up to date with need a look.
+		var outdated []string
+		for key, version := range batch {
+			current, ok := cache.Peek(key)
+			if ok && currentVersion(current) >= version || !ok && !cache.Index().Has(key) {
+				continue
+			}
+			outdated = append(outdated, key)
+		}
+		if len(outdated) == 0 {
+			return nil
+		}
+
+		exists, err := be.ProjectsExist(ctx, outdated)
+		if err != nil {
+			return err
+		}
+		for i, key := range outdated {
+			_, held := cache.Peek(key)
+			switch {
+			case exists[i]:
+				// Reloaded on the next request.
+				cache.Delete(key)
+			case held:
+				cacheTombstone(cache, key, batch[key])
+			default:
+				cache.Index().Remove(key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("checking project versions: %w", err)
+	}
+	log.Println("Local cache resynced from Redis.")
+	return seq, nil
+}
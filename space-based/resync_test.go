@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSeqTrackerObserve(t *testing.T) {
+	var tr seqTracker
+	tr.reset(10)
+
+	if tr.observe(0) || tr.observe(11) || tr.expired() {
+		t.Fatal("in-order updates reported as lost")
+	}
+	if tr.observe(14) {
+		t.Fatal("a small gap triggered a resync right away")
+	}
+	if len(tr.missing) != 2 || tr.next != 15 {
+		t.Fatalf("tracker = %+v, want 12 and 13 missing", tr)
+	}
+
+	// Late messages fill the gap.
+	tr.observe(13)
+	tr.observe(12)
+	if len(tr.missing) != 0 || tr.expired() {
+		t.Fatalf("tracker = %+v, want no gaps", tr)
+	}
+	if tr.observe(11) {
+		t.Fatal("a duplicate was reported as a gap")
+	}
+
+	if !tr.observe(15 + maxTrackedGap + 1) {
+		t.Fatal("a large gap did not trigger a resync")
+	}
+	if tr.next != 15+maxTrackedGap+2 || len(tr.missing) != 0 {
+		t.Fatalf("tracker = %+v, want it reset after the large gap", tr)
+	}
+}
+
+func TestSeqTrackerExpired(t *testing.T) {
+	var tr seqTracker
+	tr.reset(0)
+	tr.observe(2)
+	if tr.expired() {
+		t.Fatal("a fresh gap expired")
+	}
+	tr.missing[1] = time.Now().Add(-gapGrace - time.Millisecond)
+	if !tr.expired() {
+		t.Fatal("a gap older than gapGrace did not expire")
+	}
+}
+
+func TestResyncCache(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+
+	current := cachedProject{Data: json.RawMessage(`{"v":2}`), Version: 2}.encode()
+	mr.HSet("projects", "project:org:kept", current)
+	mr.HSet(versionsKey, "project:org:kept", "2")
+	mr.HSet(versionsKey, "project:org:deleted", "5")
+	mr.HSet(versionsKey, "project:org:other", "7")
+
+	cacheProject(cache, "project:org:kept", cachedProject{Data: json.RawMessage(`{"v":1}`), Version: 1}.encode(), 0)
+	cacheProject(cache, "project:org:deleted", cachedProject{Data: json.RawMessage(`{}`), Version: 3}.encode(), 0)
+
+	if _, err := resyncCache(context.Background(), be, cache); err != nil {
+		t.Fatalf("resyncCache: %v", err)
+	}
+
+	if value, _ := cache.Get("project:org:kept"); value != current {
+		t.Fatalf("kept project = %q, want the version from Redis", value)
+	}
+	value, _ := cache.Get("project:org:deleted")
+	if p, err := decodeProject(value); err != nil || !p.Deleted || p.Version != 5 {
+		t.Fatalf("deleted project = %q, want a tombstone", value)
+	}
+	if value, ok := cache.Get("project:org:other"); ok {
+		t.Fatalf("a key the pod did not hold got %q", value)
+	}
+}
+
+func TestSubscribeForUpdates(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		subscribeForUpdates(ctx, be, cache, 0, &SyncStatus{})
+		close(done)
+	}()
+
+	// Wait for the subscription before publishing.
+	for len(mr.PubSubChannels("")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	value := cachedProject{Data: json.RawMessage(`{"v":1}`), Version: 1}.encode()
+	publishUpdate(context.Background(), be, cache, CacheUpdate{Action: "set", Key: "project:org:repo", Value: value, Version: 1})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if got, ok := cache.Get("project:org:repo"); ok && got == value {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("update was not applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * gapGrace):
+		t.Fatal("subscribeForUpdates did not return after cancel")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Backends selectable with Config.Backend.
+const (
+	backendRedis  = "redis"  // Redis shared by all pods
+	backendMemory = "memory" // in-process, for a single-node dev server
+)
+
+// StoreView is the read-only part of a CentralStore. Values read from one
+// view are consistent with each other, but may lag slightly behind writes.
+type StoreView interface {
+	// UpdateSeq returns the sequence number of the last published update.
+	UpdateSeq(ctx context.Context) (uint64, error)
+	// Projects returns the encoded projects of keys, "" for unknown keys.
+	Projects(ctx context.Context, keys ...string) ([]string, error)
+	// ScanProjects passes all encoded projects to fn in batches.
+	ScanProjects(ctx context.Context, fn func(batch map[string]string) error) error
+	// ScanTerms passes the index terms of all projects to fn in batches.
+	ScanTerms(ctx context.Context, fn func(batch map[string][]string) error) error
+	// HotKeys returns the n project keys requested most often.
+	HotKeys(ctx context.Context, n int) ([]string, error)
+	// QueryIndex returns the project keys having all the given terms.
+	QueryIndex(ctx context.Context, terms []string) ([]string, error)
+}
+
+// CentralStore is the cache shared by all pods. It keeps the latest
+// version of every project, the not-found markers, the secondary index and
+// the fetch locks. Its own StoreView methods may read from a replica.
+type CentralStore interface {
+	StoreView
+	// View runs fn against a single consistent view.
+	View(fn func(v StoreView) error) error
+
+	// Project returns the latest encoded project of key, "" if unknown.
+	Project(ctx context.Context, key string) (string, error)
+	// ProjectsExist reports for each key whether a project is stored.
+	ProjectsExist(ctx context.Context, keys []string) ([]bool, error)
+	// ScanVersions passes the latest version of every key, including
+	// deleted keys, to fn in batches.
+	ScanVersions(ctx context.Context, fn func(batch map[string]uint64) error) error
+	// StoreVersioned writes value for key, or deletes the key if value is
+	// empty, unless a newer version was written already. If base is not
+	// zero the write fails with errVersionConflict unless the stored version
+	// is still base. terms replace the key's index terms. It reports
+	// whether the write was applied.
+	StoreVersioned(ctx context.Context, key, value string, version, base uint64, terms []string) (bool, error)
+	// NextVersion draws a new, store-wide monotonically increasing version.
+	NextVersion(ctx context.Context) (uint64, error)
+	// NextUpdateSeq draws the sequence number of the next published update.
+	NextUpdateSeq(ctx context.Context) (uint64, error)
+
+	// Missing returns the not-found markers of keys, "" for keys without one.
+	Missing(ctx context.Context, keys ...string) ([]string, error)
+	// SetMissing stores the not-found marker of key for ttl.
+	SetMissing(ctx context.Context, key, value string, ttl time.Duration) error
+	// ClearMissing removes the not-found marker of key.
+	ClearMissing(ctx context.Context, key string) error
+
+	// TryLock takes the lock of key for ttl unless it is held. token
+	// identifies the holder for Unlock.
+	TryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock of key if it is still held with token.
+	Unlock(ctx context.Context, key, token string) error
+	// Locked reports whether the lock of key is held.
+	Locked(ctx context.Context, key string) (bool, error)
+
+	// CountRequests increments the request counters of keys, see HotKeys,
+	// and drops all but the limit keys requested most often.
+	CountRequests(ctx context.Context, limit int, keys ...string) error
+
+	// Ping checks that the store is reachable.
+	Ping(ctx context.Context) error
+	// Close releases the connections of the store.
+	Close() error
+}
+
+// errReceiveTimeout is returned by UpdateSubscription.Receive when no event
+// arrived in time.
+var errReceiveTimeout = errors.New("no cache update received")
+
+// UpdateBroadcaster delivers CacheUpdate messages to every pod, the sender included.
+type UpdateBroadcaster interface {
+	// Publish sends an update to all current subscribers.
+	Publish(ctx context.Context, update CacheUpdate) error
+	// Subscribe starts receiving updates. The subscription is established
+	// in the background and reported by a Subscribed event.
+	Subscribe(ctx context.Context) UpdateSubscription
+}
+
+// UpdateSubscription receives the updates of an UpdateBroadcaster.
+type UpdateSubscription interface {
+	// Receive waits up to timeout for the next event and returns
+	// errReceiveTimeout if there was none.
+	Receive(ctx context.Context, timeout time.Duration) (UpdateEvent, error)
+	// Close ends the subscription and interrupts a pending Receive.
+	Close() error
+}
+
+// UpdateEvent is an event of an UpdateSubscription.
+type UpdateEvent struct {
+	// Subscribed is set when the subscription was established, the first
+	// time or after a reconnect; updates may have been missed in between.
+	Subscribed bool
+	// Payload is the JSON encoded CacheUpdate otherwise.
+	Payload string
+}
+
+// Backend is the central cache shared by the pods and the channel keeping
+// their local caches in sync.
+type Backend struct {
+	CentralStore
+	UpdateBroadcaster
+}
+
+// newBackend creates the configured backend.
+func newBackend(cfg Config) *Backend {
+	if cfg.Backend == backendMemory {
+		return &Backend{NewMemoryStore(), NewMemoryBroadcaster()}
+	}
+	// Writes and Pub/Sub go to the master, cache reads prefer the replicas.
+	return newRedisBackend(newRedisClient(cfg.Redis), cfg.Channels.Updates)
+}
+
+// newRedisBackend keeps the central cache in the Redis behind rdb and
+// synchronizes the pods over channel.
+func newRedisBackend(rdb *RedisClient, channel string) *Backend {
+	return &Backend{NewRedisStore(rdb, channel), NewRedisBroadcaster(rdb, channel)}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upstream loads projects from the source of truth behind the caches.
+type Upstream interface {
+	// FetchProject loads a project. If prev is not nil the request is
+	// conditional and changed is false when the project is unmodified.
+	FetchProject(ctx context.Context, org, repo string, prev *cachedProject) (p cachedProject, changed bool, err error)
+}
+
+// RateLimitError is returned while the upstream API refuses requests.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("GitHub API rate limit exceeded, retry after %s", e.RetryAfter.Round(time.Second))
+}
+
+const (
+	// minRateLimitBackoff and maxRateLimitBackoff bound the exponential backoff
+	// used when GitHub rate limits us without saying for how long.
+	minRateLimitBackoff = time.Second
+	maxRateLimitBackoff = time.Minute
+)
+
+// GitHubClient is the Upstream backed by the GitHub REST API. It authenticates
+// with a token if one is set and stops sending requests while rate limited.
+type GitHubClient struct {
+	baseURL    string
+	token      string
+	fields     []string
+	httpClient *http.Client
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+	backoff      time.Duration
+}
+
+// NewGitHubClient creates a client for the API at baseURL, e.g. "https://api.github.com".
+// token may be empty for unauthenticated requests. Fetched projects keep only
+// the given fields, see projectJSON.
+func NewGitHubClient(baseURL, token string, fields []string) *GitHubClient {
+	return &GitHubClient{
+		baseURL: baseURL,
+		token:   token,
+		fields:  fields,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// FetchProject implements Upstream.
+func (c *GitHubClient) FetchProject(ctx context.Context, org, repo string, prev *cachedProject) (p cachedProject, changed bool, err error) {
+	if wait := c.blockedFor(); wait > 0 {
+		return cachedProject{}, false, &RateLimitError{RetryAfter: wait}
+	}
+
+	githubURL := fmt.Sprintf("%s/repos/%s/%s", c.baseURL, org, repo)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, githubURL, nil)
+	if err != nil {
+		return cachedProject{}, false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return cachedProject{}, false, newUpstreamError("Error querying GitHub API", err)
+	}
+	defer resp.Body.Close()
+
+	if err := c.observeRateLimit(resp); err != nil {
+		return cachedProject{}, false, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && prev != nil {
+		p = *prev
+		p.FetchedAt = time.Now()
+		return p, false, nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return cachedProject{}, false, ErrProjectNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The body is not passed on, it may contain details meant for us only.
+		return cachedProject{}, false, &UpstreamError{
+			Message: fmt.Sprintf("GitHub API returned status %d", resp.StatusCode),
+		}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return cachedProject{}, false, newUpstreamError("Error reading GitHub response", err)
+	}
+
+	// Validate that body contains proper JSON.
+	if !json.Valid(body) {
+		return cachedProject{}, false, &UpstreamError{Message: "Invalid JSON from GitHub"}
+	}
+
+	// Compare and store only the kept fields, so that changes to other
+	// fields do not count as a change.
+	p = cachedProject{
+		Data:         projectJSON(json.RawMessage(body), c.fields),
+		FetchedAt:    time.Now(),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	changed = prev == nil || !bytes.Equal(prev.Data, p.Data)
+	return p, changed, nil
+}
+
+// blockedFor returns how long requests must still be held back.
+func (c *GitHubClient) blockedFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Until(c.blockedUntil)
+}
+
+// observeRateLimit records the rate limit state reported by a response and
+// returns a RateLimitError if the response itself was rate limited.
+func (c *GitHubClient) observeRateLimit(resp *http.Response) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	limited := resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusForbidden && (resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0"))
+
+	var until time.Time
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		until = now.Add(time.Duration(secs) * time.Second)
+	} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			until = time.Unix(reset, 0)
+		}
+	}
+
+	if !limited {
+		c.backoff = 0
+		// The last request of the window succeeded, hold back until the reset.
+		if until.After(c.blockedUntil) {
+			c.blockedUntil = until
+		}
+		return nil
+	}
+
+	if until.IsZero() {
+		// No hint from GitHub, back off exponentially.
+		if c.backoff == 0 {
+			c.backoff = minRateLimitBackoff
+		} else if c.backoff *= 2; c.backoff > maxRateLimitBackoff {
+			c.backoff = maxRateLimitBackoff
+		}
+		until = now.Add(c.backoff)
+	}
+	c.blockedUntil = until
+	return &RateLimitError{RetryAfter: until.Sub(now)}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGitHubClientFetchProject(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/org/repo" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+	client := NewGitHubClient(srv.URL, "secret", nil)
+
+	p, changed, err := client.FetchProject(context.Background(), "org", "repo", nil)
+	if err != nil || !changed {
+		t.Fatalf("FetchProject = %v, changed %v", err, changed)
+	}
+	if string(p.Data) != `{"id":1}` || p.ETag != `"v1"` || p.FetchedAt.IsZero() {
+		t.Fatalf("FetchProject = %+v", p)
+	}
+
+	prev := p
+	prev.FetchedAt = time.Now().Add(-time.Hour)
+	p, changed, err = client.FetchProject(context.Background(), "org", "repo", &prev)
+	if err != nil || changed {
+		t.Fatalf("conditional FetchProject = %v, changed %v", err, changed)
+	}
+	if string(p.Data) != `{"id":1}` || !p.FetchedAt.After(prev.FetchedAt) {
+		t.Fatalf("conditional FetchProject = %+v, want the previous data revalidated", p)
+	}
+
+	// Without an ETag match the content is compared.
+	prev.ETag = ""
+	if _, changed, err := client.FetchProject(context.Background(), "org", "repo", &prev); err != nil || changed {
+		t.Fatalf("FetchProject of same content = %v, changed %v", err, changed)
+	}
+
+	if _, _, err := client.FetchProject(context.Background(), "org", "missing", nil); !errors.Is(err, ErrProjectNotFound) {
+		t.Fatalf("FetchProject of a missing project = %v, want ErrProjectNotFound", err)
+	}
+}
+
+func TestGitHubClientReportsUpstreamErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/org/broken" {
+			w.Write([]byte("{"))
+			return
+		}
+		http.Error(w, "internal details", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	client := NewGitHubClient(srv.URL, "", nil)
+
+	var upstreamErr *UpstreamError
+	_, _, err := client.FetchProject(context.Background(), "org", "repo", nil)
+	if !errors.As(err, &upstreamErr) || upstreamErr.Message != "GitHub API returned status 500" {
+		t.Fatalf("FetchProject = %v, want an UpstreamError with the status", err)
+	}
+	_, _, err = client.FetchProject(context.Background(), "org", "broken", nil)
+	if !errors.As(err, &upstreamErr) || upstreamErr.Message != "Invalid JSON from GitHub" {
+		t.Fatalf("FetchProject of invalid JSON = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, _, err = client.FetchProject(ctx, "org", "repo", nil)
+	if !errors.As(err, &upstreamErr) || !upstreamErr.Timeout {
+		t.Fatalf("FetchProject after the deadline = %v, want a timeout", err)
+	}
+}
+
+func TestGitHubClientHonorsRateLimitReset(t *testing.T) {
+	var requests int32
+	reset := time.Now().Add(time.Hour).Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	client := NewGitHubClient(srv.URL, "", nil)
+
+	for i := 0; i < 2; i++ {
+		_, _, err := client.FetchProject(context.Background(), "org", "repo", nil)
+		var rateLimited *RateLimitError
+		if !errors.As(err, &rateLimited) {
+			t.Fatalf("FetchProject = %v, want a RateLimitError", err)
+		}
+		if rateLimited.RetryAfter < 59*time.Minute {
+			t.Fatalf("RetryAfter = %v, want about an hour", rateLimited.RetryAfter)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("GitHub got %d requests, want 1", requests)
+	}
+}
+
+func TestGitHubClientBacksOffWithoutHint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	client := NewGitHubClient(srv.URL, "", nil)
+
+	for _, want := range []time.Duration{minRateLimitBackoff, 2 * minRateLimitBackoff} {
+		client.blockedUntil = time.Time{} // skip the wait
+		_, _, err := client.FetchProject(context.Background(), "org", "repo", nil)
+		var rateLimited *RateLimitError
+		if !errors.As(err, &rateLimited) {
+			t.Fatalf("FetchProject = %v, want a RateLimitError", err)
+		}
+		if rateLimited.RetryAfter > want || rateLimited.RetryAfter < want-100*time.Millisecond {
+			t.Fatalf("RetryAfter = %v, want %v", rateLimited.RetryAfter, want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// defaultTombstoneTTL is how long a pod remembers a deleted key, so that
+// delayed updates older than the delete cannot resurrect it.
+const defaultTombstoneTTL = 10 * time.Minute
+
+// versionCounterKey is the Redis counter all project versions are drawn from.
+const versionCounterKey = "projects:version"
+
+// versionsKey is the Redis hash holding the latest version of every project
+// key. Entries stay after a project is deleted and act as its tombstone.
+const versionsKey = "project_versions"
+
+// errVersionConflict is returned when a value was changed by someone else
+// since it was read.
+var errVersionConflict = errors.New("project was modified concurrently")
+
+// cacheProject stores an encoded project in the local cache unless the cache
+// already holds a newer version of it, including a newer tombstone. ttl zero
+// uses the cache default. It reports whether the value was stored.
+func cacheProject(cache *LocalCache, key, value string, ttl time.Duration) bool {
+	p, err := decodeProject(value)
+	if err != nil {
+		log.Printf("Error decoding project %s: %v", key, err)
+		return false
+	}
+	if ttl == 0 {
+		ttl = cache.opts.TTL
+	}
+	stored := cache.SetIf(key, value, ttl, func(current string, exists bool) bool {
+		if !exists || p.Version == 0 {
+			return true
+		}
+		cur, err := decodeProject(current)
+		if err != nil {
+			return true
+		}
+		// An outdated marker is replaced by the version it announced.
+		return cur.Version < p.Version || (cur.Outdated && cur.Version == p.Version)
+	})
+	if stored {
+		indexProject(cache, key, p)
+	}
+	return stored
+}
+
+// cacheOutdated records in the local cache that key was changed to version
+// in Redis without sending the value. The value is loaded on the next request;
+// the index keeps the key's terms until then.
+func cacheOutdated(cache *LocalCache, key string, version uint64) bool {
+	value := cachedProject{Outdated: true, Version: version}.encode()
+	return cache.SetIf(key, value, cache.opts.TTL, func(current string, exists bool) bool {
+		return !exists || currentVersion(current) < version
+	})
+}
+
+// cacheTombstone records in the local cache that key was deleted at version.
+func cacheTombstone(cache *LocalCache, key string, version uint64) bool {
+	value := cachedProject{Deleted: true, Version: version}.encode()
+	stored := cache.SetIf(key, value, cache.opts.TombstoneTTL, func(current string, exists bool) bool {
+		return !exists || version == 0 || currentVersion(current) < version
+	})
+	if stored {
+		cache.Index().Remove(key)
+	}
+	return stored
+}
+
+// currentVersion returns the version of an encoded project, 0 if it has none.
+func currentVersion(value string) uint64 {
+	p, err := decodeProject(value)
+	if err != nil {
+		return 0
+	}
+	return p.Version
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCacheProjectKeepsNewerVersions(t *testing.T) {
+	cache := NewLocalCache(CacheOptions{TTL: time.Hour})
+	v1 := cachedProject{Data: json.RawMessage(`{"v":1}`), Version: 1}.encode()
+	v2 := cachedProject{Data: json.RawMessage(`{"v":2}`), Version: 2}.encode()
+
+	if !cacheProject(cache, "k", v2, 0) {
+		t.Fatal("cacheProject refused the first value")
+	}
+	if cacheProject(cache, "k", v1, 0) {
+		t.Fatal("cacheProject replaced version 2 with version 1")
+	}
+	if cacheProject(cache, "k", v2, 0) {
+		t.Fatal("cacheProject replaced version 2 with itself")
+	}
+	if value, _ := cache.Get("k"); value != v2 {
+		t.Fatalf("cache holds %q, want version 2", value)
+	}
+
+	// Values without a version, e.g. written before versioning, always apply.
+	unversioned := cachedProject{Data: json.RawMessage(`{"v":0}`)}.encode()
+	if !cacheProject(cache, "k", unversioned, 0) {
+		t.Fatal("cacheProject refused an unversioned value")
+	}
+	if cacheProject(cache, "k", "not json", 0) {
+		t.Fatal("cacheProject stored an invalid value")
+	}
+}
+
+func TestCacheTombstoneOrdering(t *testing.T) {
+	cache := NewLocalCache(CacheOptions{})
+	v2 := cachedProject{Data: json.RawMessage(`{"v":2}`), Version: 2}.encode()
+	v4 := cachedProject{Data: json.RawMessage(`{"v":4}`), Version: 4}.encode()
+	cacheProject(cache, "k", v2, 0)
+
+	if cacheTombstone(cache, "k", 1) {
+		t.Fatal("a delete older than the cached value was applied")
+	}
+	if !cacheTombstone(cache, "k", 3) {
+		t.Fatal("a newer delete was not applied")
+	}
+	// A delayed update older than the delete must not resurrect the key.
+	if cacheProject(cache, "k", v2, 0) {
+		t.Fatal("an update older than the tombstone was applied")
+	}
+	value, _ := cache.Get("k")
+	if p, err := decodeProject(value); err != nil || !p.Deleted || p.Version != 3 {
+		t.Fatalf("cache holds %q, want the tombstone", value)
+	}
+	if !cacheProject(cache, "k", v4, 0) {
+		t.Fatal("an update newer than the tombstone was not applied")
+	}
+}
+
+func TestStoreVersioned(t *testing.T) {
+	mr, be := newTestRedis(t)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		value   string
+		version uint64
+		applied bool
+	}{
+		{"v2", 2, true},
+		{"v1", 1, false},
+		{"", 2, false},
+		{"", 3, true},
+		{"v2", 2, false},
+	} {
+		applied, err := be.StoreVersioned(ctx, "k", tt.value, tt.version, 0, nil)
+		if err != nil || applied != tt.applied {
+			t.Fatalf("storeVersioned(%q, %d) = %v, %v, want %v", tt.value, tt.version, applied, err, tt.applied)
+		}
+	}
+	if mr.HGet("projects", "k") != "" {
+		t.Fatal("deleted project is still stored")
+	}
+	if got := mr.HGet(versionsKey, "k"); got != "3" {
+		t.Fatalf("stored version = %q, want the tombstone's 3", got)
+	}
+
+	v1, err := be.NextVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2, err := be.NextVersion(ctx); err != nil || v2 <= v1 {
+		t.Fatalf("nextVersion = %d after %d", v2, v1)
+	}
+}
+
+func TestStoreMissingSkipsUnknownKeys(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+
+	storeMissing(context.Background(), be, cache, "project:org:never")
+	if mr.HGet(versionsKey, "project:org:never") != "" {
+		t.Fatal("a name that never existed got a version")
+	}
+	if !mr.Exists(missingKey("project:org:never")) {
+		t.Fatal("not-found marker was not stored")
+	}
+
+	mr.HSet("projects", "project:org:gone", cachedProject{Data: json.RawMessage(`{}`), Version: 1}.encode())
+	mr.HSet(versionsKey, "project:org:gone", "1")
+	storeMissing(context.Background(), be, cache, "project:org:gone")
+	if mr.HGet("projects", "project:org:gone") != "" || mr.HGet(versionsKey, "project:org:gone") == "1" {
+		t.Fatal("a deleted project was not replaced by a newer tombstone")
+	}
+}
+
+func TestStoreVersionedBase(t *testing.T) {
+	_, be := newTestRedis(t)
+	ctx := context.Background()
+
+	if _, err := be.StoreVersioned(ctx, "k", "v1", 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if applied, err := be.StoreVersioned(ctx, "k", "v2", 2, 1, nil); err != nil || !applied {
+		t.Fatalf("write based on the stored version = %v, %v", applied, err)
+	}
+	if _, err := be.StoreVersioned(ctx, "k", "v3", 3, 1, nil); err != errVersionConflict {
+		t.Fatalf("write based on an old version = %v, want errVersionConflict", err)
+	}
+}
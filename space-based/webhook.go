@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxWebhookBytes is the largest payload GitHub delivers.
+const maxWebhookBytes = 25 << 20
+
+// webhookPayload holds the fields of push and repository events used to
+// find the affected project keys.
+type webhookPayload struct {
+	Action     string `json:"action"`
+	Repository struct {
+		FullName string `json:"full_name"` // "org/repo"
+	} `json:"repository"`
+	// Changes is set for renamed and transferred repositories.
+	Changes struct {
+		Repository struct {
+			Name struct {
+				From string `json:"from"`
+			} `json:"name"`
+		} `json:"repository"`
+		Owner struct {
+			From struct {
+				User struct {
+					Login string `json:"login"`
+				} `json:"user"`
+				Organization struct {
+					Login string `json:"login"`
+				} `json:"organization"`
+			} `json:"from"`
+		} `json:"owner"`
+	} `json:"changes"`
+}
+
+// webhookResponse reports what a delivery changed.
+type webhookResponse struct {
+	Event     string   `json:"event"`
+	Refreshed []string `json:"refreshed,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+}
+
+// signWebhookPayload returns the X-Hub-Signature-256 value GitHub sends for body.
+func signWebhookPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validWebhookSignature checks an X-Hub-Signature-256 header in constant time.
+func validWebhookSignature(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signWebhookPayload(secret, body)), []byte(signature))
+}
+
+// webhookHandler implements POST /webhooks/github. Deliveries must be signed
+// with secret. Push and repository events refresh the cached project in the
+// background, in ctx, which broadcasts the change to all pods; deleted
+// repositories are remembered as missing, and renamed and transferred ones are
+// moved to their new key, see moveProject.
+func webhookHandler(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+		if err != nil {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", "Payload too large")
+			return
+		}
+		if !validWebhookSignature(secret, body, r.Header.Get("X-Hub-Signature-256")) {
+			writeJSONError(w, http.StatusUnauthorized, "bad_signature", "Invalid X-Hub-Signature-256")
+			return
+		}
+
+		event := r.Header.Get("X-GitHub-Event")
+		resp := webhookResponse{Event: event}
+		switch event {
+		case "ping":
+			writeJSON(w, http.StatusOK, resp)
+			return
+		case "push", "repository":
+		default:
+			// Subscribed to more events than needed, nothing to do.
+			writeJSON(w, http.StatusAccepted, resp)
+			return
+		}
+
+		var payload webhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Invalid event payload")
+			return
+		}
+		org, repo, ok := strings.Cut(payload.Repository.FullName, "/")
+		if !ok || org == "" || repo == "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Event has no repository")
+			return
+		}
+		key := projectKey(org, repo)
+
+		switch {
+		case event == "repository" && payload.Action == "deleted":
+			storeMissing(r.Context(), be, cache, key)
+			resp.Removed = append(resp.Removed, key)
+		case event == "repository" && (payload.Action == "renamed" || payload.Action == "transferred"):
+			oldOrg, oldRepo := org, repo
+			if from := payload.Changes.Repository.Name.From; from != "" {
+				oldRepo = from
+			}
+			if from := payload.Changes.Owner.From.User.Login; from != "" {
+				oldOrg = from
+			} else if from := payload.Changes.Owner.From.Organization.Login; from != "" {
+				oldOrg = from
+			}
+			oldKey := projectKey(oldOrg, oldRepo)
+			if oldKey != key {
+				err := moveProject(r.Context(), be, cache, upstream, org, repo, oldKey, key)
+				if err == errVersionConflict {
+					writeJSONError(w, http.StatusConflict, "conflict", "Project was modified concurrently, retry")
+					return
+				}
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+				resp.Removed = append(resp.Removed, oldKey)
+			}
+		default:
+			if refreshCachedProject(ctx, be, cache, upstream, org, repo, key) {
+				resp.Refreshed = append(resp.Refreshed, key)
+			}
+		}
+		log.Printf("GitHub %s event for %s: refreshed %v, removed %v", event, key, resp.Refreshed, resp.Removed)
+		writeJSON(w, http.StatusAccepted, resp)
+	}
+}
+
+// refreshCachedProject schedules a refresh of a project if it is in the central cache.
+// Projects nobody asked for yet are left alone.
+func refreshCachedProject(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, key string) bool {
+	value, err := be.Project(ctx, key)
+	if err != nil {
+		log.Printf("Central cache error: %v", err)
+		return false
+	}
+	if value == "" {
+		return false
+	}
+	p, err := decodeProject(value)
+	if err != nil {
+		return false
+	}
+	// The project changed on GitHub, however recently it was fetched.
+	scheduleRefresh(ctx, be, cache, upstream, org, repo, key, p, true)
+	return true
+}
+
+// moveProject moves a renamed or transferred repository from oldKey to key.
+// The annotations of the old project are merged into those of the new one,
+// which is loaded from upstream if it is not stored yet, before the old key is
+// removed from the central cache and all local caches. Annotations already set on the new
+// key win. Moving a key that is not stored does nothing, so redelivered events
+// are harmless.
+func moveProject(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, oldKey, key string) error {
+	for attempt := 1; ; attempt++ {
+		value, err := be.Project(ctx, oldKey)
+		if err == nil && value == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		old, err := decodeProject(value)
+		if err != nil {
+			return err
+		}
+
+		if len(old.Annotations) > 0 {
+			if err := moveAnnotations(ctx, be, cache, upstream, org, repo, key, old.Annotations); err != nil {
+				return err
+			}
+		}
+		err = removeProject(ctx, be, cache, oldKey, old.Version)
+		if err != errVersionConflict || attempt == maxWriteAttempts {
+			return err
+		}
+	}
+}
+
+// moveAnnotations merges annotations into those of the project stored under key.
+func moveAnnotations(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, key string, annotations json.RawMessage) error {
+	for attempt := 1; ; attempt++ {
+		p, err := loadProject(ctx, be, cache, upstream, org, repo, key)
+		if err != nil {
+			return err
+		}
+
+		merged := map[string]interface{}{}
+		if err := json.Unmarshal(annotations, &merged); err != nil {
+			return err
+		}
+		if len(p.Annotations) > 0 {
+			var own map[string]interface{}
+			if err := json.Unmarshal(p.Annotations, &own); err != nil {
+				log.Printf("Error decoding annotations of %s: %v", key, err)
+			}
+			merged = mergePatch(merged, own)
+		}
+		if p.Annotations, err = json.Marshal(merged); err != nil {
+			return err
+		}
+
+		_, err = storeProject(ctx, be, cache, key, p, true)
+		if err != errVersionConflict || attempt == maxWriteAttempts {
+			return err
+		}
+	}
+}
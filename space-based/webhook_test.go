@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testWebhookSecret = []byte("webhook secret")
+
+// deliver sends a GitHub event to handler, signed with secret unless signature is set.
+func deliver(handler http.HandlerFunc, event, payload, signature string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/github", strings.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", event)
+	if signature == "" {
+		signature = signWebhookPayload(testWebhookSecret, []byte(payload))
+	}
+	req.Header.Set("X-Hub-Signature-256", signature)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// storedProject returns the project stored in the central cache under key.
+func storedProject(t *testing.T, be *Backend, key string) (cachedProject, bool) {
+	t.Helper()
+	value, err := be.Project(context.Background(), key)
+	if err != nil || value == "" {
+		return cachedProject{}, false
+	}
+	p, err := decodeProject(value)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", key, err)
+	}
+	return p, true
+}
+
+func TestWebhookHandlerChecksSignatures(t *testing.T) {
+	_, be := newTestRedis(t)
+	handler := webhookHandler(context.Background(), be, NewLocalCache(CacheOptions{}), newFakeUpstream(nil), testWebhookSecret)
+
+	if rec := deliver(handler, "ping", `{}`, ""); rec.Code != http.StatusOK {
+		t.Fatalf("signed ping = %d, want 200", rec.Code)
+	}
+	for _, signature := range []string{"sha256=00", signWebhookPayload([]byte("other"), []byte(`{}`)), "none"} {
+		if rec := deliver(handler, "ping", `{}`, signature); rec.Code != http.StatusUnauthorized {
+			t.Errorf("ping signed with %q = %d, want 401", signature, rec.Code)
+		}
+	}
+	if rec := deliver(handler, "issues", `{}`, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("unhandled event = %d, want 202", rec.Code)
+	}
+	if rec := deliver(handler, "push", `{"repository":{}}`, ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("push without repository = %d, want 400", rec.Code)
+	}
+}
+
+func TestWebhookHandlerRefreshesStoredProjects(t *testing.T) {
+	_, be := newTestRedis(t)
+	ctx := context.Background()
+	upstream := newFakeUpstream(map[string]string{"Org/Repo": `{"description":"new"}`, "org/other": `{"description":"old"}`})
+	cache := NewLocalCache(CacheOptions{})
+	handler := webhookHandler(ctx, be, cache, upstream, testWebhookSecret)
+
+	// The project was just fetched, but GitHub says it changed.
+	p := cachedProject{Data: json.RawMessage(`{"description":"old"}`), FetchedAt: time.Now(), Annotations: json.RawMessage(`{"types":["web"]}`)}
+	if _, err := storeProject(ctx, be, cache, "project:org:repo", p, false); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := deliver(handler, "push", `{"repository":{"full_name":"Org/Repo"}}`, "")
+	backgroundTasks.Wait()
+	var resp webhookResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("push = %d, %v", rec.Code, err)
+	}
+	if len(resp.Refreshed) != 1 || resp.Refreshed[0] != "project:org:repo" {
+		t.Fatalf("refreshed = %q, want the lower case key", resp.Refreshed)
+	}
+	if stored, _ := storedProject(t, be, "project:org:repo"); string(stored.Data) != `{"description":"new"}` || string(stored.Annotations) != `{"types":["web"]}` {
+		t.Fatalf("stored project = %s %s, want the new data with the annotations", stored.Data, stored.Annotations)
+	}
+
+	// Projects nobody asked for are not fetched.
+	deliver(handler, "push", `{"repository":{"full_name":"org/other"}}`, "")
+	backgroundTasks.Wait()
+	if _, ok := storedProject(t, be, "project:org:other"); ok || upstream.Calls() != 1 {
+		t.Fatalf("an unknown project was fetched, upstream got %d requests", upstream.Calls())
+	}
+}
+
+func TestWebhookHandlerRemembersDeletedRepositories(t *testing.T) {
+	mr, be := newTestRedis(t)
+	ctx := context.Background()
+	cache := NewLocalCache(CacheOptions{})
+	handler := webhookHandler(ctx, be, cache, newFakeUpstream(nil), testWebhookSecret)
+	storeProject(ctx, be, cache, "project:org:repo", cachedProject{Data: json.RawMessage(`{}`), FetchedAt: time.Now()}, false)
+
+	if rec := deliver(handler, "repository", `{"action":"deleted","repository":{"full_name":"org/repo"}}`, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("deleted = %d", rec.Code)
+	}
+	if !mr.Exists(missingKey("project:org:repo")) {
+		t.Fatal("deleted repository was not remembered as missing")
+	}
+}
+
+func TestWebhookHandlerMovesAnnotations(t *testing.T) {
+	_, be := newTestRedis(t)
+	ctx := context.Background()
+	upstream := newFakeUpstream(map[string]string{"Org/New": `{"name":"new"}`, "team/moved": `{"name":"moved"}`})
+	cache := NewLocalCache(CacheOptions{})
+	handler := webhookHandler(ctx, be, cache, upstream, testWebhookSecret)
+
+	store := func(key, data, annotations string) {
+		t.Helper()
+		p := cachedProject{Data: json.RawMessage(data), FetchedAt: time.Now()}
+		if annotations != "" {
+			p.Annotations = json.RawMessage(annotations)
+		}
+		if _, err := storeProject(ctx, be, cache, key, p, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(key, wantAnnotations string) {
+		t.Helper()
+		p, ok := storedProject(t, be, key)
+		if !ok || string(p.Annotations) != wantAnnotations {
+			t.Fatalf("%s = %s, %v, want annotations %s", key, p.Annotations, ok, wantAnnotations)
+		}
+	}
+	removed := func(key string) {
+		t.Helper()
+		if p, ok := storedProject(t, be, key); ok {
+			t.Fatalf("%s is still stored: %+v", key, p)
+		}
+		if value, ok := cache.Get(key); ok {
+			if p, _ := decodeProject(value); !p.Deleted {
+				t.Fatalf("%s is still cached locally: %s", key, value)
+			}
+		}
+	}
+
+	// Renamed: the new key is loaded from upstream and gets the annotations.
+	store("project:org:old", `{"name":"old"}`, `{"types":["web"],"team":"a"}`)
+	rename := `{"action":"renamed","repository":{"full_name":"Org/New"},"changes":{"repository":{"name":{"from":"Old"}}}}`
+	if rec := deliver(handler, "repository", rename, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("renamed = %d %s", rec.Code, rec.Body.String())
+	}
+	check("project:org:new", `{"team":"a","types":["web"]}`)
+	removed("project:org:old")
+	if ids := cache.Index().Query([]string{"type:web"}); len(ids) != 1 || ids[0] != "project:org:new" {
+		t.Fatalf("index = %q, want only the new key", ids)
+	}
+
+	// A redelivery finds nothing to move.
+	if rec := deliver(handler, "repository", rename, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("redelivered rename = %d", rec.Code)
+	}
+	check("project:org:new", `{"team":"a","types":["web"]}`)
+
+	// Transferred: annotations already set on the new key win.
+	store("project:team:moved", `{"name":"moved"}`, `{"team":"b"}`)
+	transfer := `{"action":"transferred","repository":{"full_name":"team/moved"},"changes":{"owner":{"from":{"organization":{"login":"org"}}}}}`
+	store("project:org:moved", `{"name":"moved"}`, `{"types":["cli"],"team":"a"}`)
+	if rec := deliver(handler, "repository", transfer, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("transferred = %d %s", rec.Code, rec.Body.String())
+	}
+	check("project:team:moved", `{"team":"b","types":["cli"]}`)
+	removed("project:org:moved")
+
+	// Without annotations the old key is just removed.
+	store("project:org:plain", `{"name":"plain"}`, "")
+	rename = `{"action":"renamed","repository":{"full_name":"org/renamed"},"changes":{"repository":{"name":{"from":"plain"}}}}`
+	if rec := deliver(handler, "repository", rename, ""); rec.Code != http.StatusAccepted {
+		t.Fatalf("renamed = %d", rec.Code)
+	}
+	removed("project:org:plain")
+	if _, ok := storedProject(t, be, "project:org:renamed"); ok {
+		t.Fatal("a project without annotations was fetched under its new key")
+	}
+}
+
+func TestWebhookHandlerKeepsAnnotationsIfTheMoveFails(t *testing.T) {
+	_, be := newTestRedis(t)
+	ctx := context.Background()
+	cache := NewLocalCache(CacheOptions{})
+	handler := webhookHandler(ctx, be, cache, newFakeUpstream(nil), testWebhookSecret)
+	p := cachedProject{Data: json.RawMessage(`{}`), FetchedAt: time.Now(), Annotations: json.RawMessage(`{"types":["web"]}`)}
+	storeProject(ctx, be, cache, "project:org:old", p, false)
+
+	// The new name cannot be loaded, so the old key must stay.
+	rename := `{"action":"renamed","repository":{"full_name":"org/new"},"changes":{"repository":{"name":{"from":"old"}}}}`
+	if rec := deliver(handler, "repository", rename, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("renamed = %d, want the upstream error", rec.Code)
+	}
+	if stored, ok := storedProject(t, be, "project:org:old"); !ok || string(stored.Annotations) != `{"types":["web"]}` {
+		t.Fatal("annotations of the old key were lost")
+	}
+}
+
+func TestProjectKeyIsCaseInsensitive(t *testing.T) {
+	_, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"Org/Repo": `{"id":1}`})
+	cache := NewLocalCache(CacheOptions{})
+	handler := getProjectHandler(context.Background(), be, cache, upstream)
+
+	if projectKey("Org", "Repo") != "project:org:repo" {
+		t.Fatalf("projectKey = %q", projectKey("Org", "Repo"))
+	}
+	get(handler, "/project/{org}/{repo}", "/project/Org/Repo")
+	if rec := get(handler, "/project/{org}/{repo}", "/project/org/REPO"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != sourceLocal {
+		t.Fatalf("GET with another spelling = %d, X-Cache %q, want the cached project", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	if calls := upstream.Calls(); calls != 1 {
+		t.Fatalf("upstream got %d requests, want 1", calls)
+	}
+}
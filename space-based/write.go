@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxAnnotationBytes limits the size of annotation request bodies.
+const maxAnnotationBytes = 64 << 10
+
+// maxWriteAttempts is how often a write is retried after a concurrent change.
+const maxWriteAttempts = 3
+
+// loadProject returns the current stored version of a project, fetching it
+// from upstream first if it has never been cached.
+func loadProject(ctx context.Context, be *Backend, cache *LocalCache, upstream Upstream, org, repo, key string) (cachedProject, error) {
+	value, err := be.Project(ctx, key)
+	if err == nil && value != "" {
+		return decodeProject(value)
+	}
+	if err != nil {
+		return cachedProject{}, err
+	}
+
+	p, _, err := upstream.FetchProject(ctx, org, repo, nil)
+	if errors.Is(err, ErrProjectNotFound) {
+		storeMissing(ctx, be, cache, key)
+	}
+	if err != nil {
+		return cachedProject{}, err
+	}
+	return storeProject(ctx, be, cache, key, p, true)
+}
+
+// annotateHandler implements PUT and PATCH /project/{org}/{repo}. The request
+// body is a JSON object of annotations, e.g. {"types": ["web"]}. PUT replaces the
+// annotations of the project, PATCH merges them as a JSON merge patch (RFC 7386).
+// The project is saved to the central cache and the local cache and broadcast to all pods.
+func annotateHandler(be *Backend, cache *LocalCache, upstream Upstream, merge bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org := chi.URLParam(r, "org")
+		repo := chi.URLParam(r, "repo")
+		if org == "" || repo == "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Missing organization or repository")
+			return
+		}
+		key := projectKey(org, repo)
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAnnotationBytes))
+		if err != nil {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, "too_large", "Request body too large")
+			return
+		}
+		var patch map[string]interface{}
+		if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Body must be a JSON object")
+			return
+		}
+
+		for attempt := 1; ; attempt++ {
+			p, err := loadProject(r.Context(), be, cache, upstream, org, repo, key)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			annotations := patch
+			if merge {
+				current := map[string]interface{}{}
+				if len(p.Annotations) > 0 {
+					if err := json.Unmarshal(p.Annotations, &current); err != nil {
+						log.Printf("Error decoding annotations of %s: %v", key, err)
+					}
+				}
+				annotations = mergePatch(current, patch)
+			}
+			p.Annotations, err = json.Marshal(annotations)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			p, err = storeProject(r.Context(), be, cache, key, p, true)
+			if err == errVersionConflict && attempt < maxWriteAttempts {
+				continue
+			}
+			if err == errVersionConflict {
+				writeJSONError(w, http.StatusConflict, "conflict", "Project was modified concurrently, retry")
+				return
+			}
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(p.body())
+			return
+		}
+	}
+}
+
+// deleteProjectHandler implements DELETE /project/{org}/{repo}. It invalidates
+// the project in the central cache and every pod's local cache, see deleteProject.
+func deleteProjectHandler(be *Backend, cache *LocalCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		org := chi.URLParam(r, "org")
+		repo := chi.URLParam(r, "repo")
+		if org == "" || repo == "" {
+			writeJSONError(w, http.StatusBadRequest, "bad_request", "Missing organization or repository")
+			return
+		}
+		key := projectKey(org, repo)
+
+		err := deleteProject(r.Context(), be, cache, key)
+		if err == errVersionConflict {
+			writeJSONError(w, http.StatusConflict, "conflict", "Project was modified concurrently, retry")
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// mergePatch applies a JSON merge patch to target: null values remove
+// fields, objects are merged recursively and everything else replaces.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	for name, value := range patch {
+		if value == nil {
+			delete(target, name)
+			continue
+		}
+		if patchObj, ok := value.(map[string]interface{}); ok {
+			targetObj, ok := target[name].(map[string]interface{})
+			if !ok {
+				targetObj = map[string]interface{}{}
+			}
+			target[name] = mergePatch(targetObj, patchObj)
+			continue
+		}
+		target[name] = value
+	}
+	return target
+}
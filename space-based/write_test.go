@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const projectPattern = "/project/{org}/{repo}"
+
+func TestAnnotateHandler(t *testing.T) {
+	mr, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"org/repo": `{"id":1}`})
+	cache := NewLocalCache(CacheOptions{})
+	put := annotateHandler(be, cache, upstream, false)
+	patch := annotateHandler(be, cache, upstream, true)
+
+	// The project is fetched from upstream before it is annotated.
+	rec := serve(put, http.MethodPut, projectPattern, "/project/org/repo", `{"type":"web","team":{"name":"a","lead":"b"}}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"annotations":{"team":{"lead":"b","name":"a"},"type":"web"},"id":1}` {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body.String())
+	}
+	if calls := upstream.Calls(); calls != 1 {
+		t.Fatalf("upstream got %d requests, want 1", calls)
+	}
+
+	rec = serve(patch, http.MethodPatch, projectPattern, "/project/org/repo", `{"type":null,"team":{"lead":"c"}}`)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"annotations":{"team":{"lead":"c","name":"a"}},"id":1}` {
+		t.Fatalf("PATCH = %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Other pods read the annotations from Redis.
+	other := getProjectHandler(context.Background(), be, NewLocalCache(CacheOptions{}), upstream)
+	if rec := get(other, projectPattern, "/project/org/repo"); rec.Body.String() != `{"annotations":{"team":{"lead":"c","name":"a"}},"id":1}` {
+		t.Fatalf("GET on another pod = %s", rec.Body.String())
+	}
+	stored, err := decodeProject(mr.HGet("projects", "project:org:repo"))
+	if err != nil || stored.Version == 0 {
+		t.Fatalf("stored project = %+v, %v", stored, err)
+	}
+}
+
+func TestAnnotateHandlerRejectsBadRequests(t *testing.T) {
+	_, be := newTestRedis(t)
+	upstream := newFakeUpstream(nil)
+	put := annotateHandler(be, NewLocalCache(CacheOptions{}), upstream, false)
+
+	for _, body := range []string{"", "[]", "null", "{"} {
+		if rec := serve(put, http.MethodPut, projectPattern, "/project/org/repo", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("PUT %q = %d, want 400", body, rec.Code)
+		}
+	}
+	if rec := serve(put, http.MethodPut, projectPattern, "/project/org/missing", `{}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("PUT of an unknown project = %d, want 404", rec.Code)
+	}
+}
+
+func TestDeleteProjectHandler(t *testing.T) {
+	mr, be := newTestRedis(t)
+	cache := NewLocalCache(CacheOptions{})
+	del := deleteProjectHandler(be, cache)
+	ctx := context.Background()
+
+	plain, err := storeProject(ctx, be, cache, "project:org:plain", cachedProject{Data: json.RawMessage(`{"id":1}`), FetchedAt: time.Now()}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotated, err := storeProject(ctx, be, cache, "project:org:annotated", cachedProject{
+		Data:        json.RawMessage(`{"id":2}`),
+		FetchedAt:   time.Now(),
+		ETag:        `"v1"`,
+		Annotations: json.RawMessage(`{"type":"web"}`),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A project without annotations is removed.
+	if rec := serve(del, http.MethodDelete, projectPattern, "/project/org/plain", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", rec.Code)
+	}
+	if mr.HGet("projects", "project:org:plain") != "" {
+		t.Fatal("project is still stored")
+	}
+	value, _ := cache.Get("project:org:plain")
+	if p, err := decodeProject(value); err != nil || !p.Deleted || p.Version <= plain.Version {
+		t.Fatalf("local cache holds %q, want a tombstone", value)
+	}
+
+	// An annotated project keeps its annotations and is revalidated.
+	if rec := serve(del, http.MethodDelete, projectPattern, "/project/org/annotated", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d", rec.Code)
+	}
+	p, err := decodeProject(mr.HGet("projects", "project:org:annotated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(p.Annotations) != `{"type":"web"}` || !p.stale(defaultFreshFor) || p.ETag != "" || p.Version <= annotated.Version {
+		t.Fatalf("stored project = %+v, want the annotations kept and the data stale", p)
+	}
+
+	// Unknown keys are left alone.
+	if rec := serve(del, http.MethodDelete, projectPattern, "/project/org/unknown", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE of an unknown project = %d", rec.Code)
+	}
+	if mr.HGet(versionsKey, "project:org:unknown") != "" {
+		t.Fatal("DELETE of an unknown project recorded a version")
+	}
+}
+
+func TestDeleteProjectRevalidatesAnnotatedProjects(t *testing.T) {
+	_, be := newTestRedis(t)
+	upstream := newFakeUpstream(map[string]string{"org/repo": `{"id":2}`})
+	cache := NewLocalCache(CacheOptions{})
+	ctx := context.Background()
+
+	_, err := storeProject(ctx, be, cache, "project:org:repo", cachedProject{
+		Data:        json.RawMessage(`{"id":1}`),
+		FetchedAt:   time.Now(),
+		Annotations: json.RawMessage(`{"type":"web"}`),
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteProject(ctx, be, cache, "project:org:repo"); err != nil {
+		t.Fatal(err)
+	}
+
+	value, _ := cache.Get("project:org:repo")
+	prev, err := decodeProject(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshProject(ctx, be, cache, upstream, "org", "repo", "project:org:repo", prev, false)
+
+	value, _ = cache.Get("project:org:repo")
+	if p, err := decodeProject(value); err != nil || string(p.body()) != `{"annotations":{"type":"web"},"id":2}` {
+		t.Fatalf("refreshed project = %s, %v", p.body(), err)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	target := map[string]interface{}{
+		"a": "x",
+		"b": map[string]interface{}{"c": 1.0, "d": 2.0},
+		"e": []interface{}{1.0},
+	}
+	patch := map[string]interface{}{
+		"a": nil,
+		"b": map[string]interface{}{"c": nil, "f": 3.0},
+		"e": "scalar",
+		"g": map[string]interface{}{"h": true},
+	}
+	want := map[string]interface{}{
+		"b": map[string]interface{}{"d": 2.0, "f": 3.0},
+		"e": "scalar",
+		"g": map[string]interface{}{"h": true},
+	}
+	if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergePatch = %v, want %v", got, want)
+	}
+}